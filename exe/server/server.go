@@ -1,6 +1,9 @@
 package main
 
 import (
+	// report.timezone must load in images without a zoneinfo database
+	_ "time/tzdata"
+
 	"github.com/lakelink/auth-companion/in"
 	"github.com/lakelink/auth-companion/misc"
 	"github.com/lakelink/auth-companion/out"
@@ -11,11 +14,21 @@ func main() {
 	misc.SetupConfig()
 	misc.SetupLogger()
 
-	newApiActor := out.NewNewApiActor(viper.GetString("newapi.db_path"))
+	store := out.NewStore(viper.GetString("store.db_path"))
+	newApiActor := out.NewNewApiActor(viper.GetString("newapi.mode"), store)
 	feishuActor := out.NewFeishuActor()
-	zitadelActor := out.NewZitadelActor(viper.GetString("zitadel.domain"), viper.GetString("zitadel.pat"), viper.GetString("zitadel.feishu_idp_id"))
+	zitadelActor := out.NewZitadelActor(viper.GetString("zitadel.domain"), viper.GetString("zitadel.pat"), viper.GetString("zitadel.feishu_idp_id"), viper.GetBool("zitadel.dry_run"), store)
+	offboarder := in.NewOffboarder(store, zitadelActor, newApiActor)
+	reconciler := in.NewReconciler(feishuActor, zitadelActor, offboarder)
+	reporter := in.NewReporter(newApiActor, feishuActor, store)
+	grantSyncer := in.NewGrantSyncer(feishuActor, zitadelActor, store)
+	inbox := in.NewFeishuInbox(store, in.NewFeishuEventHandler(zitadelActor, grantSyncer, offboarder))
 	done := make(chan error)
-	go in.StartEchoListener(newApiActor, feishuActor, done)
-	go in.StartFeishuListener(zitadelActor, done)
+	go in.StartEchoListener(newApiActor, feishuActor, zitadelActor, store, reconciler, offboarder, reporter, inbox, done)
+	go in.StartReconciler(reconciler, viper.GetDuration("reconcile.interval"))
+	go offboarder.Start()
+	go reporter.Start()
+	go inbox.Start()
+	go in.StartFeishuListener(inbox, done)
 	<-done
 }
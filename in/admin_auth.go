@@ -0,0 +1,34 @@
+package in
+
+import (
+	"crypto/hmac"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// NewAdminAuth guards the admin endpoints with the bearer token admin.token.
+// Without one configured they are closed to everyone.
+func NewAdminAuth() echo.MiddlewareFunc {
+	token := []byte(viper.GetString("admin.token"))
+	if len(token) == 0 {
+		log.Warn().Msg("admin.token is not set, admin endpoints are disabled")
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if len(token) == 0 {
+				return c.String(http.StatusForbidden, "admin endpoints disabled")
+			}
+
+			bearer, ok := bearerToken(c)
+			if !ok || !hmac.Equal([]byte(bearer), token) {
+				log.Warn().Str("uri", c.Request().RequestURI).Str("remote_ip", c.RealIP()).Msg("rejected admin caller")
+				return c.String(http.StatusUnauthorized, "unauthorized")
+			}
+			return next(c)
+		}
+	}
+}
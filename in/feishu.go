@@ -7,35 +7,79 @@ import (
 
 	"github.com/lakelink/auth-companion/out"
 	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+	larkevent "github.com/larksuite/oapi-sdk-go/v3/event"
 	"github.com/larksuite/oapi-sdk-go/v3/event/dispatcher"
 	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
+func isFeishuUserActive(status *larkcontact.UserStatus) bool {
+	if status == nil {
+		return false
+	}
+	// the list API leaves out the flags that are false
+	return larkcore.BoolValue(status.IsActivated) &&
+		!(larkcore.BoolValue(status.IsExited) ||
+			larkcore.BoolValue(status.IsFrozen) ||
+			larkcore.BoolValue(status.IsResigned) ||
+			larkcore.BoolValue(status.IsUnjoin))
+}
+
 type FeishuEventHandler struct {
 	zitadelActor *out.ZitadelActor
+	grantSyncer  *GrantSyncer
+	offboarder   *Offboarder
 }
 
-func SetupFeishuEventHandler(disp *dispatcher.EventDispatcher, zitadelActor *out.ZitadelActor) *dispatcher.EventDispatcher {
-	h := FeishuEventHandler{zitadelActor}
-	disp = disp.OnP2UserCreatedV3(h.handleUserCreated)
-	disp = disp.OnP2UserUpdatedV3(h.handleUserUpdated)
-	disp = disp.OnP2UserDeletedV3(h.handleUserDeleted)
+func NewFeishuEventHandler(zitadelActor *out.ZitadelActor, grantSyncer *GrantSyncer, offboarder *Offboarder) *FeishuEventHandler {
+	return &FeishuEventHandler{zitadelActor, grantSyncer, offboarder}
+}
+
+// SetupFeishuEventHandler only persists the events into the inbox, the
+// FeishuEventHandler processes them from there.
+func SetupFeishuEventHandler(disp *dispatcher.EventDispatcher, inbox *FeishuInbox) *dispatcher.EventDispatcher {
+	disp = disp.OnP2UserCreatedV3(func(ctx context.Context, event *larkcontact.P2UserCreatedV3) error {
+		return inbox.Enqueue(event.EventV2Base, event.Event)
+	})
+	disp = disp.OnP2UserUpdatedV3(func(ctx context.Context, event *larkcontact.P2UserUpdatedV3) error {
+		return inbox.Enqueue(event.EventV2Base, event.Event)
+	})
+	disp = disp.OnP2UserDeletedV3(func(ctx context.Context, event *larkcontact.P2UserDeletedV3) error {
+		return inbox.Enqueue(event.EventV2Base, event.Event)
+	})
+	disp = disp.OnP2DepartmentCreatedV3(func(ctx context.Context, event *larkcontact.P2DepartmentCreatedV3) error {
+		return inbox.Enqueue(event.EventV2Base, event.Event)
+	})
+	disp = disp.OnP2DepartmentUpdatedV3(func(ctx context.Context, event *larkcontact.P2DepartmentUpdatedV3) error {
+		return inbox.Enqueue(event.EventV2Base, event.Event)
+	})
+	disp = disp.OnP2DepartmentDeletedV3(func(ctx context.Context, event *larkcontact.P2DepartmentDeletedV3) error {
+		return inbox.Enqueue(event.EventV2Base, event.Event)
+	})
+	for _, eventType := range viper.GetStringSlice("feishu.group_event_types") {
+		disp = disp.OnCustomizedEvent(eventType, func(ctx context.Context, event *larkevent.EventReq) error {
+			return inbox.EnqueueRaw(event.Body)
+		})
+	}
 
 	return disp
 }
 
 func (h *FeishuEventHandler) handleUserCreated(ctx context.Context, event *larkcontact.P2UserCreatedV3) error {
 	fmt.Printf("[ OnP2UserCreatedV3 access ], data: %s\n", larkcore.Prettify(event))
-	_, _, err := h.zitadelActor.AddUserFromFeishu(event.Event.Object)
-	return err
+	_, userId, err := h.zitadelActor.AddUserFromFeishu(event.Event.Object)
+	if err != nil {
+		return err
+	}
+	return h.grantSyncer.SyncUser(event.Event.Object, userId)
 }
 
 func (h *FeishuEventHandler) handleUserUpdated(ctx context.Context, event *larkcontact.P2UserUpdatedV3) error {
 	fmt.Printf("[ OnP2UserUpdatedV3 access ], data: %s\n", larkcore.Prettify(event))
-	status := *event.Event.Object.Status
+	status := event.Event.Object.Status
 
-	log.Info().Any("status", *event.Event.Object.Status).Msg("updating activated user")
+	log.Info().Any("status", status).Msg("updating activated user")
 
 	_, userId, err := h.zitadelActor.UpdateUserFromFeishu(event.Event.Object)
 	if errors.Is(err, out.ErrZitadelRequireEmail) {
@@ -43,8 +87,8 @@ func (h *FeishuEventHandler) handleUserUpdated(ctx context.Context, event *larkc
 		return nil
 	}
 
-	if errors.Is(err, out.ErrZitadelRequireEnName) {
-		log.Warn().Err(err).Str("missing", "enName").Msg("incomplete feishu user profile")
+	if errors.Is(err, out.ErrZitadelRequireName) {
+		log.Warn().Err(err).Str("missing", "name").Msg("incomplete feishu user profile")
 		return nil
 	}
 
@@ -57,27 +101,32 @@ func (h *FeishuEventHandler) handleUserUpdated(ctx context.Context, event *larkc
 		return err
 	}
 
-	ok := *status.IsActivated && !(*status.IsExited || *status.IsFrozen || *status.IsResigned || *status.IsUnjoin)
-	if ok {
-		err = h.zitadelActor.ReactivateUser(userId)
-		if err != nil {
-			log.Warn().Err(err).Str("userId", userId).Msg("could not reactivate user")
-		}
+	if err := h.grantSyncer.SyncUser(event.Event.Object, userId); err != nil {
+		return err
+	}
 
-		return nil
-	} else {
-		log.Info().Any("status", *event.Event.Object.Status).Msg("deactivate inactivated user")
-		err = h.zitadelActor.DeactivateUser(userId)
-		if err != nil {
-			log.Warn().Err(err).Str("userId", userId).Msg("could not deactivate user")
-		}
+	if !isFeishuUserActive(status) {
+		log.Info().Any("status", status).Msg("offboarding inactivated user")
+		return h.offboarder.Offboard(userId)
+	}
 
-		return nil
+	// old_object only holds the changed fields, a status there means it
+	// changed
+	if old := event.Event.OldObject; old != nil && old.Status != nil && !isFeishuUserActive(old.Status) {
+		log.Info().Any("status", status).Msg("reboarding reactivated user")
+		return h.offboarder.Reboard(userId)
 	}
+	return nil
 }
 
 func (h *FeishuEventHandler) handleUserDeleted(ctx context.Context, event *larkcontact.P2UserDeletedV3) error {
 	fmt.Printf("[ OnP2UserDeletedV3 access ], data: %s\n", larkcore.Prettify(event))
-	_, err := h.zitadelActor.DeactivateUserFromFeishu(event.Event.Object)
-	return err
+	userId, err := h.zitadelActor.FindUserIdFromFeishu(event.Event.Object)
+	if err != nil {
+		log.Error().Err(err).Str("action", "offboard").Any("unionId", event.Event.Object.UnionId).Msg("failed to find ZITADEL user")
+		return err
+	}
+
+	log.Info().Str("userId", userId).Msg("offboarding deleted user")
+	return h.offboarder.Offboard(userId)
 }
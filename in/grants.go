@@ -0,0 +1,310 @@
+package in
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/lakelink/auth-companion/misc"
+	"github.com/lakelink/auth-companion/out"
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// GrantSyncer derives the ZITADEL project roles of a user from their feishu
+// departments and user groups, following zitadel.department_grants and
+// zitadel.group_grants.
+type GrantSyncer struct {
+	feishuActor  *out.FeishuActor
+	zitadelActor *out.ZitadelActor
+	store        *out.Store
+	departments  []misc.ZitadelGrantConfig
+	groups       []misc.ZitadelGrantConfig
+
+	mu        sync.Mutex
+	ancestors map[string][]string // open_department_id -> parents, nearest first
+}
+
+func NewGrantSyncer(feishuActor *out.FeishuActor, zitadelActor *out.ZitadelActor, store *out.Store) *GrantSyncer {
+	var departments, groups []misc.ZitadelGrantConfig
+	if err := viper.UnmarshalKey("zitadel.department_grants", &departments); err != nil {
+		log.Error().Err(err).Msg("invalid zitadel.department_grants")
+	}
+	if err := viper.UnmarshalKey("zitadel.group_grants", &groups); err != nil {
+		log.Error().Err(err).Msg("invalid zitadel.group_grants")
+	}
+
+	return &GrantSyncer{
+		feishuActor:  feishuActor,
+		zitadelActor: zitadelActor,
+		store:        store,
+		departments:  departments,
+		groups:       groups,
+		ancestors:    map[string][]string{},
+	}
+}
+
+func (g *GrantSyncer) enabled() bool {
+	return len(g.departments) > 0 || len(g.groups) > 0
+}
+
+func (g *GrantSyncer) departmentAncestors(departmentId string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if ancestors, ok := g.ancestors[departmentId]; ok {
+		return ancestors, nil
+	}
+
+	ancestors, err := g.feishuActor.ListDepartmentAncestors(departmentId)
+	if err != nil {
+		return nil, err
+	}
+	g.ancestors[departmentId] = ancestors
+	return ancestors, nil
+}
+
+func (g *GrantSyncer) invalidateDepartments() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ancestors = map[string][]string{}
+}
+
+func (g *GrantSyncer) managed() out.ZitadelGrantSet {
+	managed := out.ZitadelGrantSet{}
+	for _, m := range g.departments {
+		managed.Add(m.ProjectId, m.RoleKeys...)
+	}
+	for _, m := range g.groups {
+		managed.Add(m.ProjectId, m.RoleKeys...)
+	}
+	return managed
+}
+
+func (g *GrantSyncer) desired(e *larkcontact.UserEvent) (out.ZitadelGrantSet, error) {
+	desired := out.ZitadelGrantSet{}
+
+	for _, departmentId := range e.DepartmentIds {
+		var ancestors []string
+		for _, m := range g.departments {
+			if m.Id == departmentId {
+				desired.Add(m.ProjectId, m.RoleKeys...)
+				continue
+			}
+			if !m.IncludeChildren {
+				continue
+			}
+
+			if ancestors == nil {
+				var err error
+				ancestors, err = g.departmentAncestors(departmentId)
+				if err != nil {
+					return nil, err
+				}
+			}
+			for _, a := range ancestors {
+				if m.Id == a {
+					desired.Add(m.ProjectId, m.RoleKeys...)
+					break
+				}
+			}
+		}
+	}
+
+	if len(g.groups) > 0 && e.OpenId != nil {
+		groupIds, err := g.feishuActor.ListUserGroups(*e.OpenId)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range g.groups {
+			if slices.Contains(groupIds, m.Id) {
+				desired.Add(m.ProjectId, m.RoleKeys...)
+			}
+		}
+	}
+
+	return desired, nil
+}
+
+// SyncUser adds and removes the mapped roles of the ZITADEL user to match the
+// departments and user groups of the feishu user.
+func (g *GrantSyncer) SyncUser(e *larkcontact.UserEvent, userId string) error {
+	if !g.enabled() || userId == "" {
+		return nil
+	}
+
+	desired, err := g.desired(e)
+	if err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to resolve feishu departments and groups")
+		return err
+	}
+
+	return g.zitadelActor.SyncUserGrants(userId, desired, g.managed())
+}
+
+// SyncDepartment re-syncs every user below the department, used when the
+// department tree changes.
+func (g *GrantSyncer) SyncDepartment(departmentId string) error {
+	g.invalidateDepartments()
+	if !g.enabled() {
+		return nil
+	}
+
+	users, err := g.feishuActor.ListDepartmentUsers(departmentId)
+	if err != nil {
+		return err
+	}
+
+	return g.syncUsers(users)
+}
+
+func (g *GrantSyncer) syncUsers(users []*larkcontact.UserEvent) error {
+	var errs []error
+	for _, e := range users {
+		userId, err := g.zitadelActor.FindUserIdFromFeishu(e)
+		if errors.Is(err, out.ErrZitadelUserNotFound) {
+			continue
+		}
+		if err == nil {
+			err = g.SyncUser(e, userId)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SyncGroup re-syncs the current members of the user group and the ones that
+// were members when it was last synced. Members that failed to sync stay
+// remembered, so a retry still finds the ones that left.
+func (g *GrantSyncer) SyncGroup(groupId string) error {
+	if !slices.ContainsFunc(g.groups, func(m misc.ZitadelGrantConfig) bool { return m.Id == groupId }) {
+		return nil
+	}
+
+	members, err := g.feishuActor.ListGroupMembers(groupId)
+	if err != nil {
+		return err
+	}
+
+	previous, err := g.store.FeishuGroupMembers(groupId)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	seen := map[string]bool{}
+	remembered := slices.Clone(members)
+	for _, openId := range append(members, previous...) {
+		if seen[openId] {
+			continue
+		}
+		seen[openId] = true
+
+		e, err := g.feishuActor.GetUser(openId)
+		switch {
+		case errors.Is(err, out.ErrFeishuUserNotFound):
+			// gone from feishu, so no longer a member either
+			err = g.revokeGroup(groupId, openId)
+		case err == nil:
+			err = g.syncUsers([]*larkcontact.UserEvent{e})
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("openId", openId).Str("group", groupId).Msg("could not sync feishu group member")
+			errs = append(errs, err)
+			if !slices.Contains(members, openId) {
+				remembered = append(remembered, openId)
+			}
+		}
+	}
+
+	errs = append(errs, g.store.SetFeishuGroupMembers(groupId, remembered))
+	return errors.Join(errs...)
+}
+
+// revokeGroup removes the roles of the user group from a former member that
+// feishu no longer knows, found through the identity recorded for it.
+func (g *GrantSyncer) revokeGroup(groupId, openId string) error {
+	identity, err := g.store.LookupIdentity(openId)
+	if errors.Is(err, out.ErrIdentityNotFound) || (err == nil && identity.ZitadelUserId == "") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	managed := out.ZitadelGrantSet{}
+	for _, m := range g.groups {
+		if m.Id == groupId {
+			managed.Add(m.ProjectId, m.RoleKeys...)
+		}
+	}
+	return g.zitadelActor.SyncUserGrants(identity.ZitadelUserId, out.ZitadelGrantSet{}, managed)
+}
+
+// SyncGroups re-syncs every configured user group.
+func (g *GrantSyncer) SyncGroups() error {
+	var errs []error
+	for _, m := range g.groups {
+		errs = append(errs, g.SyncGroup(m.Id))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *FeishuEventHandler) handleDepartmentCreated(ctx context.Context, event *larkcontact.P2DepartmentCreatedV3) error {
+	// a new department has no members yet
+	h.grantSyncer.invalidateDepartments()
+	return nil
+}
+
+func (h *FeishuEventHandler) handleDepartmentUpdated(ctx context.Context, event *larkcontact.P2DepartmentUpdatedV3) error {
+	if event.Event.Object == nil || event.Event.Object.OpenDepartmentId == nil {
+		return errors.New("department event without open_department_id")
+	}
+
+	log.Info().Str("department", *event.Event.Object.OpenDepartmentId).Msg("feishu department updated, re-syncing grants")
+	return h.grantSyncer.SyncDepartment(*event.Event.Object.OpenDepartmentId)
+}
+
+func (h *FeishuEventHandler) handleDepartmentDeleted(ctx context.Context, event *larkcontact.P2DepartmentDeletedV3) error {
+	// feishu only deletes empty departments, the members were moved and
+	// already produced user_updated events
+	h.grantSyncer.invalidateDepartments()
+	return nil
+}
+
+// feishuGroupEvent is the part of a user group event needed to find the
+// group, which is either at the top of the event or in its object.
+type feishuGroupEvent struct {
+	Event struct {
+		GroupId string `json:"group_id"`
+		Object  struct {
+			GroupId string `json:"group_id"`
+		} `json:"object"`
+	} `json:"event"`
+}
+
+func (h *FeishuEventHandler) handleGroupEvent(ctx context.Context, payload []byte) error {
+	var event feishuGroupEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	groupId := event.Event.GroupId
+	if groupId == "" {
+		groupId = event.Event.Object.GroupId
+	}
+
+	if groupId == "" {
+		log.Warn().Msg("feishu group event without group_id, re-syncing all groups")
+		return h.grantSyncer.SyncGroups()
+	}
+
+	log.Info().Str("group", groupId).Msg("feishu user group changed, re-syncing grants")
+	return h.grantSyncer.SyncGroup(groupId)
+}
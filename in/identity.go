@@ -0,0 +1,30 @@
+package in
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/out"
+)
+
+type IdentityHandler struct {
+	store *out.Store
+}
+
+func SetupIdentityEndpoints(g *echo.Group, store *out.Store, admin echo.MiddlewareFunc) {
+	h := IdentityHandler{store}
+	g.GET("/:id", h.handleLookup, admin)
+}
+
+// handleLookup returns every identifier linked to the given Feishu, ZITADEL,
+// New API or Open WebUI ID, or email.
+func (h *IdentityHandler) handleLookup(c echo.Context) error {
+	identity, err := h.store.LookupIdentity(c.Param("id"))
+	if errors.Is(err, out.ErrIdentityNotFound) {
+		return c.String(http.StatusNotFound, "identity not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, identity)
+}
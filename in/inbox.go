@@ -0,0 +1,318 @@
+package in
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/out"
+	larkevent "github.com/larksuite/oapi-sdk-go/v3/event"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	// an event claimed by a worker that crashed becomes due again after this
+	feishuInboxLease = 5 * time.Minute
+	// feishu stops redelivering long before this
+	feishuProcessedEventRetention = 7 * 24 * time.Hour
+)
+
+type feishuInboxProcessor func(ctx context.Context, payload []byte) error
+
+// feishuInboxEvent is the stored form of a feishu event, decodable into the
+// matching larkcontact.P2*V3 type.
+type feishuInboxEvent struct {
+	Schema string                 `json:"schema"`
+	Header *larkevent.EventHeader `json:"header"`
+	Event  any                    `json:"event"`
+}
+
+func inboxProcessor[T any](handle func(context.Context, *T) error) feishuInboxProcessor {
+	return func(ctx context.Context, payload []byte) error {
+		var event T
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		return handle(ctx, &event)
+	}
+}
+
+// FeishuInbox persists every feishu contact event before it is processed, so
+// nothing is lost when ZITADEL is unreachable. Failed events are retried with
+// exponential backoff and dead-lettered after feishu.inbox.max_attempts.
+type FeishuInbox struct {
+	store      *out.Store
+	processors map[string]feishuInboxProcessor
+
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	wake      chan struct{}
+	userLocks sync.Map
+}
+
+func NewFeishuInbox(store *out.Store, h *FeishuEventHandler) *FeishuInbox {
+	b := &FeishuInbox{
+		store: store,
+		processors: map[string]feishuInboxProcessor{
+			"contact.user.created_v3": inboxProcessor(h.handleUserCreated),
+			"contact.user.updated_v3": inboxProcessor(h.handleUserUpdated),
+			"contact.user.deleted_v3": inboxProcessor(h.handleUserDeleted),
+
+			"contact.department.created_v3": inboxProcessor(h.handleDepartmentCreated),
+			"contact.department.updated_v3": inboxProcessor(h.handleDepartmentUpdated),
+			"contact.department.deleted_v3": inboxProcessor(h.handleDepartmentDeleted),
+		},
+		workers:     max(viper.GetInt("feishu.inbox.workers"), 1),
+		maxAttempts: max(viper.GetInt("feishu.inbox.max_attempts"), 1),
+		backoff:     viper.GetDuration("feishu.inbox.backoff"),
+		maxBackoff:  viper.GetDuration("feishu.inbox.max_backoff"),
+		wake:        make(chan struct{}, 1),
+	}
+
+	for _, eventType := range viper.GetStringSlice("feishu.group_event_types") {
+		b.processors[eventType] = h.handleGroupEvent
+	}
+
+	return b
+}
+
+// Enqueue stores the event and wakes the workers.
+func (b *FeishuInbox) Enqueue(base *larkevent.EventV2Base, data any) error {
+	if base == nil || base.Header == nil {
+		return errors.New("feishu event has no header")
+	}
+
+	payload, err := json.Marshal(feishuInboxEvent{base.Schema, base.Header, data})
+	if err != nil {
+		return err
+	}
+
+	added, err := b.store.EnqueueInboxEvent(base.Header.EventID, base.Header.EventType, payload)
+	if err != nil {
+		log.Error().Err(err).Str("eventId", base.Header.EventID).Str("eventType", base.Header.EventType).Msg("failed to persist feishu event")
+		return err
+	}
+
+	if !added {
+		log.Info().Str("eventId", base.Header.EventID).Msg("feishu event already in inbox")
+		return nil
+	}
+
+	log.Info().Str("eventId", base.Header.EventID).Str("eventType", base.Header.EventType).Msg("feishu event queued")
+	b.notify()
+
+	return nil
+}
+
+// EnqueueRaw stores an event the SDK has no type for, given its plain body.
+func (b *FeishuInbox) EnqueueRaw(body []byte) error {
+	var event struct {
+		larkevent.EventV2Base
+		Event json.RawMessage `json:"event"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return err
+	}
+	return b.Enqueue(&event.EventV2Base, event.Event)
+}
+
+func (b *FeishuInbox) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// exponentialBackoff doubles base for every failed attempt after the first,
+// up to limit.
+func exponentialBackoff(base, limit time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// feishuInboxEventMeta is the part of a stored event used for ordering.
+type feishuInboxEventMeta struct {
+	Header *larkevent.EventHeader `json:"header"`
+	Event  struct {
+		Object struct {
+			OpenId string `json:"open_id"`
+		} `json:"object"`
+	} `json:"event"`
+}
+
+// lockUser serialises events of the same feishu user across workers.
+func (b *FeishuInbox) lockUser(openId string) func() {
+	if openId == "" {
+		return func() {}
+	}
+	m, _ := b.userLocks.LoadOrStore(openId, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (b *FeishuInbox) process(e *out.InboxEvent) {
+	logger := log.With().Int64("id", e.Id).Str("eventId", e.EventId).Str("eventType", e.EventType).Int("attempt", e.Attempts+1).Logger()
+
+	var meta feishuInboxEventMeta
+	if err := json.Unmarshal(e.Payload, &meta); err != nil {
+		logger.Warn().Err(err).Msg("could not read event metadata, ordering is not enforced")
+	}
+	openId := meta.Event.Object.OpenId
+	var createTime int64
+	if meta.Header != nil {
+		createTime, _ = strconv.ParseInt(meta.Header.CreateTime, 10, 64)
+	}
+
+	defer b.lockUser(openId)()
+
+	if openId != "" && createTime > 0 {
+		version, err := b.store.FeishuUserVersion(openId)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to read feishu user version")
+		} else if createTime < version {
+			logger.Info().Str("openId", openId).Int64("createTime", createTime).Int64("newest", version).Msg("discarding stale feishu event")
+			if err := b.store.CompleteInboxEvent(e, "", 0); err != nil {
+				logger.Error().Err(err).Msg("failed to remove stale event from inbox")
+			}
+			return
+		}
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		processor, ok := b.processors[e.EventType]
+		if !ok {
+			return fmt.Errorf("no processor for event type %s", e.EventType)
+		}
+		return processor(context.Background(), e.Payload)
+	}()
+
+	if err == nil {
+		if err := b.store.CompleteInboxEvent(e, openId, createTime); err != nil {
+			logger.Error().Err(err).Msg("failed to remove processed event from inbox")
+		}
+		logger.Info().Msg("feishu event processed")
+		return
+	}
+
+	if e.Attempts+1 >= b.maxAttempts {
+		logger.Error().Err(err).Msg("feishu event failed for good, moving to dead letters")
+		if err := b.store.DeadLetterInboxEvent(e.Id, err); err != nil {
+			logger.Error().Err(err).Msg("failed to dead-letter event")
+		}
+		return
+	}
+
+	delay := exponentialBackoff(b.backoff, b.maxBackoff, e.Attempts+1)
+	logger.Warn().Err(err).Dur("retryIn", delay).Msg("feishu event failed, will retry")
+	if err := b.store.RetryInboxEvent(e.Id, err, time.Now().Add(delay)); err != nil {
+		logger.Error().Err(err).Msg("failed to schedule retry")
+	}
+}
+
+// Start runs the worker pool, it never returns.
+func (b *FeishuInbox) Start() {
+	jobs := make(chan *out.InboxEvent)
+	for i := 0; i < b.workers; i++ {
+		go func() {
+			for e := range jobs {
+				b.process(e)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var prunedAt time.Time
+	for {
+		if time.Since(prunedAt) > time.Hour {
+			if err := b.store.PruneProcessedFeishuEvents(feishuProcessedEventRetention); err != nil {
+				log.Error().Err(err).Msg("failed to prune processed feishu events")
+			}
+			prunedAt = time.Now()
+		}
+
+		events, err := b.store.ClaimInboxEvents(b.workers*2, feishuInboxLease)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to claim feishu inbox events")
+		}
+
+		for _, e := range events {
+			jobs <- e
+		}
+
+		if len(events) == 0 {
+			select {
+			case <-ticker.C:
+			case <-b.wake:
+			}
+		}
+	}
+}
+
+func (b *FeishuInbox) handleListDeadLetters(c echo.Context) error {
+	events, err := b.store.ListDeadLetters()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, events)
+}
+
+func (b *FeishuInbox) handleGetDeadLetter(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+
+	event, err := b.store.GetDeadLetter(id)
+	if errors.Is(err, out.ErrDeadLetterNotFound) {
+		return c.String(http.StatusNotFound, err.Error())
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, event)
+}
+
+func (b *FeishuInbox) handleReplayDeadLetter(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+
+	err = b.store.ReplayDeadLetter(id)
+	if errors.Is(err, out.ErrDeadLetterNotFound) {
+		return c.String(http.StatusNotFound, err.Error())
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	log.Info().Int64("id", id).Msg("replaying dead-lettered feishu event")
+	b.notify()
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+func SetupFeishuEndpoints(g *echo.Group, inbox *FeishuInbox, admin echo.MiddlewareFunc) {
+	g.GET("/dead_letters", inbox.handleListDeadLetters, admin)
+	g.GET("/dead_letters/:id", inbox.handleGetDeadLetter, admin)
+	g.POST("/dead_letters/:id/replay", inbox.handleReplayDeadLetter, admin)
+}
@@ -3,6 +3,7 @@ package in
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -14,9 +15,9 @@ import (
 	"github.com/spf13/viper"
 )
 
-func StartFeishuListener(zitadelActor *out.ZitadelActor, done chan<- error) {
+func StartFeishuListener(inbox *FeishuInbox, done chan<- error) {
 	eventHandler := dispatcher.NewEventDispatcher(viper.GetString("feishu.verification_token"), viper.GetString("feishu.encrypt_key"))
-	eventHandler = SetupFeishuEventHandler(eventHandler, zitadelActor)
+	eventHandler = SetupFeishuEventHandler(eventHandler, inbox)
 
 	app_id, app_secret := viper.GetString("feishu.app_id"), viper.GetString("feishu.app_secret")
 	cli := larkws.NewClient(app_id, app_secret,
@@ -31,9 +32,23 @@ func StartFeishuListener(zitadelActor *out.ZitadelActor, done chan<- error) {
 	done <- err
 }
 
-func StartEchoListener(newApiActor *out.NewApiActor, feishuActor *out.FeishuActor, done chan<- error) {
+func StartReconciler(reconciler *Reconciler, interval time.Duration) {
+	if interval <= 0 {
+		log.Info().Msg("periodic reconciliation disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reconciler.Run(false)
+	}
+}
+
+func StartEchoListener(newApiActor *out.NewApiActor, feishuActor *out.FeishuActor, zitadelActor *out.ZitadelActor, store *out.Store, reconciler *Reconciler, offboarder *Offboarder, reporter *Reporter, inbox *FeishuInbox, done chan<- error) {
 
 	e := echo.New()
+	e.IPExtractor = trustedProxies(viper.GetStringSlice("trusted_proxies"))
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		LogURI:       true,
 		LogStatus:    true,
@@ -63,14 +78,22 @@ func StartEchoListener(newApiActor *out.NewApiActor, feishuActor *out.FeishuActo
 		return c.String(http.StatusOK, "Hello, World!")
 	})
 
+	admin := NewAdminAuth()
+
 	gZitadel := e.Group("/zitadel")
-	SetupZitadelEndpoints(gZitadel)
+	SetupZitadelEndpoints(gZitadel, zitadelActor, reconciler, offboarder, admin)
+
+	gFeishu := e.Group("/feishu")
+	SetupFeishuEndpoints(gFeishu, inbox, admin)
 
 	gOpenWebUi := e.Group("/open-webui")
-	SetupOpenWebUiEndpoints(gOpenWebUi, newApiActor)
+	SetupOpenWebUiEndpoints(gOpenWebUi, newApiActor, zitadelActor, store, NewOpenWebUiAuthenticator())
 
 	gNewApi := e.Group("/newapi")
-	SetupNewApiEndpoints(gNewApi, feishuActor)
+	SetupNewApiEndpoints(gNewApi, feishuActor, newApiActor, reporter, admin)
+
+	gIdentity := e.Group("/identity")
+	SetupIdentityEndpoints(gIdentity, store, admin)
 
 	err := e.Start(viper.GetString("listen_addr"))
 	e.Logger.Fatal(err)
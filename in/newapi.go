@@ -1,15 +1,17 @@
 package in
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"sort"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
-	"github.com/lakelink/auth-companion/misc"
 	"github.com/lakelink/auth-companion/out"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 )
 
 type newApiWebhookPayload struct {
@@ -22,69 +24,140 @@ type newApiWebhookPayload struct {
 
 type NewApiEventHandler struct {
 	feishuActor *out.FeishuActor
-	dst         map[string]string
+	newApiActor *out.NewApiActor
+	router      *NewApiRouter
+}
+
+// newApiCardColors colors the card header by New API's notification type.
+var newApiCardColors = map[string]string{
+	"quota_exceed":   "orange",
+	"channel_update": "red",
+	"channel_test":   "yellow",
+}
+
+func (body *newApiWebhookPayload) content() string {
+	return fillValues(body.Content, body.Values)
+}
+
+// fields lists the values, objects are spread into their keys.
+func (body *newApiWebhookPayload) fields() []out.NotificationField {
+	fields := []out.NotificationField{}
+	for i, v := range body.Values {
+		if m, ok := v.(map[string]any); ok {
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fields = append(fields, out.NotificationField{Key: k, Value: formatValue(m[k])})
+			}
+			continue
+		}
+		fields = append(fields, out.NotificationField{Key: fmt.Sprintf("Value %d", i+1), Value: formatValue(v)})
+	}
+	return fields
+}
+
+func (body *newApiWebhookPayload) notification(src, remoteIp string) *out.Notification {
+	return &out.Notification{
+		Type:      body.Type,
+		Title:     body.Title,
+		Content:   body.content(),
+		Fields:    body.fields(),
+		Timestamp: body.Timestamp,
+		Color:     newApiCardColors[body.Type],
+		Source:    src,
+		RemoteIp:  remoteIp,
+		Location:  reportLocation(),
+	}
 }
 
 func (h *NewApiEventHandler) handleNotification(c echo.Context) error {
 	src := c.Param("source")
 
-	if dst, ok := h.dst[src]; ok {
+	source, ok := h.router.sources[src]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "src -> dst mapping not configured")
+	}
 
-		receiver := strings.SplitN(dst, ":", 2)
+	raw, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	release, err := source.verifier.verify(c, raw)
+	if err != nil {
+		log.Warn().Err(err).Str("src", src).Str("remote_ip", c.RealIP()).Msg("rejected webhook event")
+		return echo.NewHTTPError(http.StatusUnauthorized, "unauthorized")
+	}
 
-		if len(receiver) < 2 {
-			log.Error().Strs("receiver", receiver).Msg("incorrect dst, missing receive_id_type or receive_id")
-			return echo.NewHTTPError(http.StatusInternalServerError, "incorrect dst format")
-		}
+	var body newApiWebhookPayload
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "malformed payload")
+	}
 
-		var body newApiWebhookPayload
-		if err := c.Bind(&body); err != nil {
-			return err
-		}
+	log.Info().
+		Str("src", src).
+		Str("type", body.Type).
+		Str("title", body.Title).
+		Str("content", body.Content).
+		Any("values", body.Values).
+		Int64("timestamp", body.Timestamp).
+		Msg("received new webhook event")
+
+	n := body.notification(src, c.RealIP())
+	targets := h.router.route(source, n)
+	if len(targets) == 0 {
+		log.Warn().Str("src", src).Str("type", body.Type).Msg("no route for webhook event, dropping")
+		return nil
+	}
 
-		log.Info().
-			Str("src", src).
-			Str("dst", dst).
-			Str("type", body.Type).
-			Str("title", body.Title).
-			Str("content", body.Content).
-			Any("values", body.Values).
-			Int64("timestamp", body.Timestamp).
-			Msg("received new webhook event")
-
-		content := body.Content
-		if len(body.Values) > 0 {
-			content = fmt.Sprintf(strings.ReplaceAll(body.Content, "{{value}}", "%+v"), body.Values...)
+	var errs []error
+	for _, t := range targets {
+		if err := t.sink.Notify(renderContent(t.template, &body, n)); err != nil {
+			log.Error().Err(err).Str("src", src).Str("route", t.route).Str("actor", t.Actor).Str("dst", t.Dst).Msg("failed to deliver webhook event")
+			errs = append(errs, err)
 		}
+	}
 
-		err := h.feishuActor.SendTextMessage(
-			receiver[0],
-			receiver[1],
-			fmt.Sprintf(
-				"Received: from %s\nFrom: %s\nSubject: %s\n\n%s",
-				c.RealIP(), src, body.Title, content,
-			),
-		)
-		return err
-	} else {
-		return echo.NewHTTPError(http.StatusNotFound, "src -> dst mapping not configured")
+	// a retry would deliver the event twice to the destinations that got it
+	if len(errs) == len(targets) {
+		release()
+		return errors.Join(errs...)
+	} else if len(errs) > 0 {
+		log.Warn().Str("src", src).Int("failed", len(errs)).Int("targets", len(targets)).Msg("webhook event partially delivered, not asking for a retry")
 	}
+	return nil
+}
 
+func SetupNewApiEndpoints(g *echo.Group, feishu *out.FeishuActor, newApiActor *out.NewApiActor, reporter *Reporter, admin echo.MiddlewareFunc) {
+	h := NewApiEventHandler{feishu, newApiActor, NewNewApiRouter(feishu)}
+
+	g.POST("/notification/:source", h.handleNotification)
+	g.POST("/routes/test", h.router.handleTest, admin)
+	g.GET("/users/:oidc_user_id/tokens", h.handleListTokens, admin)
+	g.DELETE("/tokens/:id", h.handleRevokeToken, admin)
+	g.GET("/reports/:name", reporter.handlePreview, admin)
+	g.POST("/reports/:name", reporter.handleRun, admin)
 }
 
-func SetupNewApiEndpoints(g *echo.Group, feishu *out.FeishuActor) {
-	m := map[string]string{}
+func (h *NewApiEventHandler) handleListTokens(c echo.Context) error {
+	tokens, err := h.newApiActor.ListTokens(c.Param("oidc_user_id"))
+	if err != nil {
+		return newApiErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
 
-	var mappings []misc.NewApiWebhookConfig
-	viper.UnmarshalKey("newapi.webhooks", &mappings)
-	for _, v := range mappings {
-		if v.Actor != "feishu" {
-			log.Error().Str("src", v.Src).Str("dst", v.Dst).Str("actor", v.Actor).Msg("webhook handler only supports FeishuActor")
-			continue
-		}
-		m[v.Src] = v.Dst
+// handleRevokeToken lets admins revoke any token, e.g. a leaked one.
+func (h *NewApiEventHandler) handleRevokeToken(c echo.Context) error {
+	tokenId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request")
 	}
-	h := NewApiEventHandler{feishu, m}
 
-	g.POST("/notification/:source", h.handleNotification)
+	if err := h.newApiActor.RevokeTokenById(tokenId); err != nil {
+		return newApiErrorResponse(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
 }
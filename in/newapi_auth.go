@@ -0,0 +1,186 @@
+package in
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/misc"
+	"github.com/rs/zerolog/log"
+)
+
+// New API signs webhooks sent with a secret twice: the hex HMAC-SHA256 of
+// the body, and the secret itself as bearer token.
+const NewApiSignatureHeader = "X-Webhook-Signature"
+
+// replayCache remembers the digests of accepted requests until their
+// timestamp leaves the allowed skew, after which the skew check rejects them.
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]int64 // digest, expiry
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: map[[sha256.Size]byte]int64{}}
+}
+
+// add records the digest until expiry, failing if it is already recorded.
+// Calling release forgets it again.
+func (r *replayCache) add(digest [sha256.Size]byte, expiry int64) (release func(), err error) {
+	now := time.Now().Unix()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for d, e := range r.seen {
+		if e < now {
+			delete(r.seen, d)
+		}
+	}
+	if _, ok := r.seen[digest]; ok {
+		return func() {}, errors.New("replayed request")
+	}
+	r.seen[digest] = expiry
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.seen, digest)
+	}, nil
+}
+
+// newApiWebhookVerifier checks that a notification comes from New API:
+// signed with Secret, from AllowedIps, and not older than MaxSkew or seen
+// before.
+type newApiWebhookVerifier struct {
+	secret     []byte
+	allowedIps []netip.Prefix
+	maxSkew    time.Duration
+	seen       *replayCache
+}
+
+func newNewApiWebhookVerifier(c misc.NewApiWebhookConfig) (*newApiWebhookVerifier, error) {
+	v := &newApiWebhookVerifier{
+		secret:  []byte(c.Secret),
+		maxSkew: c.MaxSkew,
+		seen:    newReplayCache(),
+	}
+
+	for _, ip := range c.AllowedIps {
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, errors.New("invalid allowed IP " + ip)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		v.allowedIps = append(v.allowedIps, prefix)
+	}
+
+	if len(v.secret) == 0 {
+		log.Warn().Str("src", c.Src).Msg("webhook source has no secret, anyone can post notifications to it")
+	}
+	return v, nil
+}
+
+func (v *newApiWebhookVerifier) verifyIp(remoteIp string) error {
+	if len(v.allowedIps) == 0 {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(remoteIp)
+	if err != nil {
+		return errors.New("malformed remote IP")
+	}
+	for _, prefix := range v.allowedIps {
+		if prefix.Contains(addr.Unmap()) {
+			return nil
+		}
+	}
+	return errors.New("remote IP not allowed")
+}
+
+// verifySecret prefers the signature, which also covers the body.
+func (v *newApiWebhookVerifier) verifySecret(c echo.Context, body []byte) error {
+	if len(v.secret) == 0 {
+		return nil
+	}
+
+	if signature := c.Request().Header.Get(NewApiSignatureHeader); signature != "" {
+		expected, err := hex.DecodeString(signature)
+		if err != nil {
+			return errors.New("malformed signature")
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(body)
+		if !hmac.Equal(expected, mac.Sum(nil)) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+
+	if token, ok := bearerToken(c); ok && hmac.Equal([]byte(token), v.secret) {
+		return nil
+	}
+	return errors.New("missing or wrong bearer token")
+}
+
+// verifyFresh rejects a payload whose timestamp is outside of MaxSkew, and
+// one identical to a payload accepted within it. Calling release forgets the
+// payload, so New API's retry of an undelivered one is accepted.
+func (v *newApiWebhookVerifier) verifyFresh(body []byte) (release func(), err error) {
+	release = func() {}
+	if v.maxSkew <= 0 {
+		return release, nil
+	}
+
+	var payload struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Timestamp == 0 {
+		return release, errors.New("missing timestamp")
+	}
+	if skew := time.Since(time.Unix(payload.Timestamp, 0)).Abs(); skew > v.maxSkew {
+		return release, errors.New("timestamp outside of max_skew")
+	}
+
+	return v.seen.add(sha256.Sum256(body), payload.Timestamp+int64(v.maxSkew/time.Second)+1)
+}
+
+// verify accepts the notification, see verifyFresh for release.
+func (v *newApiWebhookVerifier) verify(c echo.Context, body []byte) (release func(), err error) {
+	if err := v.verifyIp(c.RealIP()); err != nil {
+		return func() {}, err
+	}
+	if err := v.verifySecret(c, body); err != nil {
+		return func() {}, err
+	}
+	return v.verifyFresh(body)
+}
+
+// trustedProxies only takes the client IP from X-Forwarded-For if the peer
+// is one of the proxies, so AllowedIps cannot be bypassed by setting it.
+// Without any listed no proxy is trusted and the peer is the client.
+func trustedProxies(cidrs []string) echo.IPExtractor {
+	if len(cidrs) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Error().Err(err).Str("cidr", cidr).Msg("invalid trusted proxy, skipping")
+			continue
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
@@ -0,0 +1,84 @@
+package in
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/misc"
+)
+
+func newApiWebhookContext(body, signature string) echo.Context {
+	req := httptest.NewRequest(http.MethodPost, "/newapi/notification/test", strings.NewReader(body))
+	if signature != "" {
+		req.Header.Set(NewApiSignatureHeader, signature)
+	}
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestNewApiWebhookVerifier(t *testing.T) {
+	v, err := newNewApiWebhookVerifier(misc.NewApiWebhookConfig{Src: "test", Secret: "s3cret", MaxSkew: 5 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"type":"quota_exceed","title":"Quota exceeded","timestamp":` + strconv.FormatInt(time.Now().Unix(), 10) + `}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	release, err := v.verify(newApiWebhookContext(body, signature), []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify(newApiWebhookContext(body, signature), []byte(body)); err == nil {
+		t.Error("accepted a replay")
+	}
+
+	// undelivered, New API retries
+	release()
+	if _, err := v.verify(newApiWebhookContext(body, signature), []byte(body)); err != nil {
+		t.Errorf("rejected the retry of a released payload: %v", err)
+	}
+	if _, err := v.verify(newApiWebhookContext(body, signature), []byte(body)); err == nil {
+		t.Error("accepted a replay of the retry")
+	}
+
+	if _, err := v.verify(newApiWebhookContext(body, strings.Repeat("0", 64)), []byte(body)); err == nil {
+		t.Error("accepted a wrong signature")
+	}
+	stale := `{"type":"quota_exceed","timestamp":` + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10) + `}`
+	mac.Reset()
+	mac.Write([]byte(stale))
+	if _, err := v.verify(newApiWebhookContext(stale, hex.EncodeToString(mac.Sum(nil))), []byte(stale)); err == nil {
+		t.Error("accepted a payload outside of max_skew")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		peer    string
+		want    string
+	}{
+		{"none trusted", nil, "10.0.0.2:1234", "10.0.0.2"},
+		{"listed proxy", []string{"10.0.0.0/24"}, "10.0.0.2:1234", "203.0.113.7"},
+		{"unlisted peer", []string{"10.0.0.0/24"}, "10.0.1.2:1234", "10.0.1.2"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = tt.peer
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+		if got := trustedProxies(tt.proxies)(req); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
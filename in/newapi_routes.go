@@ -0,0 +1,226 @@
+package in
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"text/template"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/misc"
+	"github.com/lakelink/auth-companion/out"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// the route name of a source's default route
+const newApiDefaultRoute = "default"
+
+type newApiDst struct {
+	misc.NotificationDstConfig
+	sink out.NotificationSink
+}
+
+type newApiSource struct {
+	misc.NewApiWebhookConfig
+	verifier   *newApiWebhookVerifier
+	defaultDst *newApiDst
+	template   *template.Template
+}
+
+type newApiRoute struct {
+	misc.NewApiRouteConfig
+	title    *regexp.Regexp
+	value    *regexp.Regexp
+	dsts     []*newApiDst
+	template *template.Template
+}
+
+// newApiTarget is a destination a notification is routed to, and the route
+// that sent it there.
+type newApiTarget struct {
+	route    string
+	template *template.Template
+	*newApiDst
+}
+
+// NewApiRouter routes the notifications of newapi.webhooks sources by
+// newapi.routes.
+type NewApiRouter struct {
+	sources map[string]*newApiSource
+	routes  []*newApiRoute
+}
+
+func newNewApiDst(c misc.NotificationDstConfig, feishuActor *out.FeishuActor) (*newApiDst, error) {
+	switch c.Format {
+	case "":
+		c.Format = out.NotificationFormatText
+	case out.NotificationFormatText, out.NotificationFormatCard:
+	default:
+		log.Error().Str("dst", c.Dst).Str("format", c.Format).Msg("unknown notification format, using text")
+		c.Format = out.NotificationFormatText
+	}
+
+	sink, err := out.NewNotificationSink(c, feishuActor)
+	if err != nil {
+		return nil, err
+	}
+	return &newApiDst{c, sink}, nil
+}
+
+// parseNewApiTemplate parses a route's template, nil if there is none.
+func parseNewApiTemplate(name, text string, funcs template.FuncMap) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+func newNewApiRoute(c misc.NewApiRouteConfig, feishuActor *out.FeishuActor, funcs template.FuncMap) (*newApiRoute, error) {
+	r := &newApiRoute{NewApiRouteConfig: c}
+
+	var err error
+	if r.template, err = parseNewApiTemplate(c.Name, c.Template, funcs); err != nil {
+		return nil, err
+	}
+	if c.Title != "" {
+		if r.title, err = regexp.Compile(c.Title); err != nil {
+			return nil, err
+		}
+	}
+	if c.Value != "" {
+		if r.value, err = regexp.Compile(c.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range c.Dsts {
+		dst, err := newNewApiDst(d, feishuActor)
+		if err != nil {
+			log.Error().Err(err).Str("route", c.Name).Str("dst", d.Dst).Str("actor", d.Actor).Msg("invalid route destination, skipping")
+			continue
+		}
+		r.dsts = append(r.dsts, dst)
+	}
+	if len(r.dsts) == 0 {
+		return nil, errors.New("no valid destination")
+	}
+	return r, nil
+}
+
+func NewNewApiRouter(feishuActor *out.FeishuActor) *NewApiRouter {
+	r := &NewApiRouter{sources: map[string]*newApiSource{}}
+	funcs := newApiTemplateFuncs()
+
+	var sources []misc.NewApiWebhookConfig
+	viper.UnmarshalKey("newapi.webhooks", &sources)
+	for _, c := range sources {
+		verifier, err := newNewApiWebhookVerifier(c)
+		if err != nil {
+			log.Error().Err(err).Str("src", c.Src).Msg("invalid webhook verification, skipping")
+			continue
+		}
+
+		s := &newApiSource{NewApiWebhookConfig: c, verifier: verifier}
+		if s.template, err = parseNewApiTemplate(c.Src, c.Template, funcs); err != nil {
+			log.Error().Err(err).Str("src", c.Src).Msg("invalid webhook template, skipping")
+			continue
+		}
+		if c.Actor != "" {
+			if s.defaultDst, err = newNewApiDst(c.DefaultDst(), feishuActor); err != nil {
+				log.Error().Err(err).Str("src", c.Src).Str("dst", c.Dst).Str("actor", c.Actor).Msg("invalid default route, skipping")
+				continue
+			}
+		}
+		r.sources[c.Src] = s
+	}
+
+	var routes []misc.NewApiRouteConfig
+	if err := viper.UnmarshalKey("newapi.routes", &routes); err != nil {
+		log.Error().Err(err).Msg("invalid newapi.routes")
+	}
+	for _, c := range routes {
+		route, err := newNewApiRoute(c, feishuActor, funcs)
+		if err != nil {
+			log.Error().Err(err).Str("route", c.Name).Msg("invalid route, skipping")
+			continue
+		}
+		r.routes = append(r.routes, route)
+	}
+
+	return r
+}
+
+func (r *newApiRoute) matches(src string, n *out.Notification) bool {
+	if r.Src != "" && r.Src != src {
+		return false
+	}
+	if len(r.Types) > 0 && !slices.Contains(r.Types, n.Type) {
+		return false
+	}
+	if r.title != nil && !r.title.MatchString(n.Title) {
+		return false
+	}
+	if r.value != nil {
+		return slices.ContainsFunc(n.Fields, func(f out.NotificationField) bool {
+			return r.value.MatchString(f.Value)
+		})
+	}
+	return true
+}
+
+// route finds where a notification of the source goes, the source's default
+// route if no route matches.
+func (r *NewApiRouter) route(s *newApiSource, n *out.Notification) []newApiTarget {
+	targets := []newApiTarget{}
+	for _, route := range r.routes {
+		if !route.matches(s.Src, n) {
+			continue
+		}
+		for _, dst := range route.dsts {
+			targets = append(targets, newApiTarget{route.Name, route.template, dst})
+		}
+		if !route.Continue {
+			break
+		}
+	}
+
+	if len(targets) == 0 && s.defaultDst != nil {
+		targets = append(targets, newApiTarget{newApiDefaultRoute, s.template, s.defaultDst})
+	}
+	return targets
+}
+
+// handleTest shows where the sample payload in the body would be sent by
+// the source ?source=, "default" if not given, and with which content.
+// Nothing is sent.
+func (r *NewApiRouter) handleTest(c echo.Context) error {
+	src := c.QueryParam("source")
+	if src == "" {
+		src = "default"
+	}
+
+	s, ok := r.sources[src]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "source not configured")
+	}
+
+	var body newApiWebhookPayload
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	n := body.notification(src, c.RealIP())
+	targets := []map[string]string{}
+	for _, t := range r.route(s, n) {
+		targets = append(targets, map[string]string{
+			"route":   t.route,
+			"actor":   t.Actor,
+			"dst":     t.Dst,
+			"format":  t.Format,
+			"content": renderContent(t.template, &body, n).Content,
+		})
+	}
+	return c.JSON(http.StatusOK, targets)
+}
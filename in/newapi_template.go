@@ -0,0 +1,151 @@
+package in
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lakelink/auth-companion/out"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// New API's placeholder in content, filled with values in order
+const newApiValuePlaceholder = "{{value}}"
+
+// formatValue renders a JSON value, numbers without exponent and objects
+// and arrays as JSON.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%+v", v)
+		}
+		return string(b)
+	}
+}
+
+// fillValues replaces the placeholders in content with values, without
+// interpreting anything else in it. Placeholders without a value are left.
+func fillValues(content string, values []any) string {
+	var b strings.Builder
+	for _, v := range values {
+		before, after, ok := strings.Cut(content, newApiValuePlaceholder)
+		if !ok {
+			break
+		}
+		b.WriteString(before)
+		b.WriteString(formatValue(v))
+		content = after
+	}
+	b.WriteString(content)
+	return b.String()
+}
+
+// newApiTemplateData is what a route's template renders the content from.
+type newApiTemplateData struct {
+	Type      string
+	Title     string
+	Content   string // as sent, with placeholders
+	Message   string // Content with placeholders filled
+	Values    []any
+	Timestamp int64
+	Source    string
+}
+
+// Value is the i-th value formatted, empty if there is none.
+func (d *newApiTemplateData) Value(i int) string {
+	if i < 0 || i >= len(d.Values) {
+		return ""
+	}
+	return formatValue(d.Values[i])
+}
+
+func toFloat(v any) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+}
+
+// newApiTemplateFuncs are the helpers of route templates:
+//   - date "2006-01-02 15:04" .Timestamp formats unix seconds in report.timezone
+//   - quota (.Value 0) formats quota as dollars by report.quota_per_unit
+//   - truncate 100 .Message cuts to at most n runes, marked with …
+func newApiTemplateFuncs() template.FuncMap {
+	loc := reportLocation()
+	quotaPerUnit := viper.GetFloat64("report.quota_per_unit")
+
+	return template.FuncMap{
+		"date": func(layout string, ts any) (string, error) {
+			f, err := toFloat(ts)
+			if err != nil {
+				return "", err
+			}
+			return time.Unix(int64(f), 0).In(loc).Format(layout), nil
+		},
+		"quota": func(quota any) (string, error) {
+			f, err := toFloat(quota)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("$%.2f", f/quotaPerUnit), nil
+		},
+		"truncate": func(n int, s string) string {
+			if utf8.RuneCountInString(s) <= n {
+				return s
+			}
+			return string([]rune(s)[:max(n-1, 0)]) + "…"
+		},
+	}
+}
+
+// renderContent gives the notification the content of the template, or
+// leaves it as is if the template fails.
+func renderContent(t *template.Template, body *newApiWebhookPayload, n *out.Notification) *out.Notification {
+	if t == nil {
+		return n
+	}
+
+	data := &newApiTemplateData{
+		Type:      body.Type,
+		Title:     body.Title,
+		Content:   body.Content,
+		Message:   n.Content,
+		Values:    body.Values,
+		Timestamp: body.Timestamp,
+		Source:    n.Source,
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		log.Error().Err(err).Str("template", t.Name()).Msg("failed to render notification")
+		return n
+	}
+
+	rendered := *n
+	rendered.Content = strings.TrimSpace(b.String())
+	return &rendered
+}
@@ -0,0 +1,109 @@
+package in
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const testNewApiTemplate = `{{.Type}}: {{.Title}}
+at {{date "2006-01-02 15:04 MST" .Timestamp}}
+{{truncate 120 .Message}}
+{{range $i, $v := .Values}}value {{$i}}: {{$.Value $i}}
+{{end}}{{if eq .Type "channel_test"}}{{with .Values}}{{if gt (len .) 1}}quota: {{quota (index . 1)}}{{end}}{{end}}{{end}}`
+
+func setTestReportConfig(t *testing.T, timezone string) {
+	for key, value := range map[string]any{"report.timezone": timezone, "report.quota_per_unit": 500000} {
+		old := viper.Get(key)
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, old) })
+	}
+}
+
+func readTestPayload(t *testing.T, path string) *newApiWebhookPayload {
+	t.Helper()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body newApiWebhookPayload
+	if err := json.Unmarshal(raw, &body); err != nil {
+		t.Fatal(err)
+	}
+	return &body
+}
+
+// TestNewApiTemplateGolden fills and renders the payloads in testdata, New
+// API's own notifications and placeholder and value count mismatches.
+func TestNewApiTemplateGolden(t *testing.T) {
+	setTestReportConfig(t, "Asia/Shanghai")
+	tmpl, err := parseNewApiTemplate("test", testNewApiTemplate, newApiTemplateFuncs())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range payloads {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			body := readTestPayload(t, path)
+			n := body.notification("newapi", "192.0.2.1")
+
+			got := "-- fillValues --\n" + fillValues(body.Content, body.Values) +
+				"\n-- renderContent --\n" + renderContent(tmpl, body, n).Content + "\n"
+
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestRenderContentFailure(t *testing.T) {
+	setTestReportConfig(t, "Asia/Shanghai")
+	tmpl, err := parseNewApiTemplate("test", `{{quota (.Value 1)}}`, newApiTemplateFuncs())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := readTestPayload(t, "testdata/quota_exceed.json")
+	n := body.notification("newapi", "192.0.2.1")
+	if got := renderContent(tmpl, body, n); got != n {
+		t.Errorf("a failed template changed the content to %q", got.Content)
+	}
+}
+
+func TestNewApiTemplateFuncsInvalidTimezone(t *testing.T) {
+	setTestReportConfig(t, "Mars/Olympus_Mons")
+
+	date := newApiTemplateFuncs()["date"].(func(string, any) (string, error))
+	got, err := date(time.RFC3339, float64(1760700000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "2025-10-17T11:20:00Z" {
+		t.Errorf("got %q, want the time in UTC", got)
+	}
+}
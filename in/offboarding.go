@@ -0,0 +1,223 @@
+package in
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/out"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	OffboardingOffboard = "offboard"
+	OffboardingReboard  = "reboard"
+
+	// a step claimed by a worker that crashed becomes due again after this
+	offboardingLease = 5 * time.Minute
+)
+
+// offboardingStep undoes (offboard) and restores (reboard) access to one
+// system, both must be idempotent.
+type offboardingStep struct {
+	name     string
+	offboard func(userId string) error
+	reboard  func(userId string) error
+}
+
+// Offboarder takes away everything a user can do once they leave feishu, and
+// gives it back when they come back. Every step is persisted and retried on
+// its own, so a New API outage does not keep the ZITADEL user active.
+type Offboarder struct {
+	store        *out.Store
+	zitadelActor *out.ZitadelActor
+	steps        []offboardingStep
+
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	wake chan struct{}
+}
+
+// ZITADEL rejects deactivating an inactive user and vice versa, which means
+// the step is already done
+func ignoreFailedPrecondition(err error) error {
+	if status.Code(err) == codes.FailedPrecondition {
+		return nil
+	}
+	return err
+}
+
+func NewOffboarder(store *out.Store, zitadelActor *out.ZitadelActor, newApiActor *out.NewApiActor) *Offboarder {
+	return &Offboarder{
+		store:        store,
+		zitadelActor: zitadelActor,
+		steps: []offboardingStep{
+			{
+				name: "zitadel_user",
+				offboard: func(userId string) error {
+					return ignoreFailedPrecondition(zitadelActor.DeactivateUser(userId))
+				},
+				reboard: func(userId string) error {
+					return ignoreFailedPrecondition(zitadelActor.ReactivateUser(userId))
+				},
+			},
+			{
+				name:     "zitadel_sessions",
+				offboard: zitadelActor.TerminateUserSessions,
+				// sessions are created again on the next login
+				reboard: func(userId string) error { return nil },
+			},
+			{
+				name:     "newapi_user",
+				offboard: newApiActor.DisableUser,
+				reboard:  newApiActor.EnableUser,
+			},
+			{
+				name:     "newapi_tokens",
+				offboard: newApiActor.DisableTokens,
+				reboard:  newApiActor.RestoreTokens,
+			},
+		},
+		maxAttempts: max(viper.GetInt("offboarding.max_attempts"), 1),
+		backoff:     viper.GetDuration("offboarding.backoff"),
+		maxBackoff:  viper.GetDuration("offboarding.max_backoff"),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+func (o *Offboarder) schedule(userId, action string) error {
+	if userId == "" {
+		return errors.New("no ZITADEL user to " + action)
+	}
+
+	// in dry-run mode only the ZITADEL mutation is recorded into the plan,
+	// nothing else is touched
+	if o.zitadelActor.IsDryRun() {
+		if action == OffboardingOffboard {
+			return o.zitadelActor.DeactivateUser(userId)
+		}
+		return o.zitadelActor.ReactivateUser(userId)
+	}
+
+	names := []string{}
+	for _, s := range o.steps {
+		names = append(names, s.name)
+	}
+
+	if err := o.store.ScheduleOffboarding(userId, action, names); err != nil {
+		log.Error().Err(err).Str("userId", userId).Str("action", action).Msg("failed to schedule offboarding")
+		return err
+	}
+
+	log.Info().Str("userId", userId).Str("action", action).Strs("steps", names).Msg("offboarding scheduled")
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Offboard deactivates the user everywhere.
+func (o *Offboarder) Offboard(userId string) error {
+	return o.schedule(userId, OffboardingOffboard)
+}
+
+// Reboard reverses Offboard.
+func (o *Offboarder) Reboard(userId string) error {
+	return o.schedule(userId, OffboardingReboard)
+}
+
+func (o *Offboarder) run(s *out.OffboardingStep) {
+	logger := log.With().Str("userId", s.UserId).Str("step", s.Step).Str("action", s.Action).Int("attempt", s.Attempts+1).Logger()
+
+	err := fmt.Errorf("unknown offboarding step %s", s.Step)
+	for _, step := range o.steps {
+		if step.name != s.Step {
+			continue
+		}
+		if s.Action == OffboardingOffboard {
+			err = step.offboard(s.UserId)
+		} else {
+			err = step.reboard(s.UserId)
+		}
+		break
+	}
+
+	if err == nil {
+		if err := o.store.CompleteOffboardingStep(s); err != nil {
+			logger.Error().Err(err).Msg("failed to complete offboarding step")
+		}
+		logger.Info().Msg("offboarding step done")
+		return
+	}
+
+	if s.Attempts+1 >= o.maxAttempts {
+		logger.Error().Err(err).Msg("offboarding step failed for good")
+		if err := o.store.FailOffboardingStep(s, err); err != nil {
+			logger.Error().Err(err).Msg("failed to record offboarding failure")
+		}
+		return
+	}
+
+	delay := exponentialBackoff(o.backoff, o.maxBackoff, s.Attempts+1)
+	logger.Warn().Err(err).Dur("retryIn", delay).Msg("offboarding step failed, will retry")
+	if err := o.store.RetryOffboardingStep(s, err, time.Now().Add(delay)); err != nil {
+		logger.Error().Err(err).Msg("failed to schedule retry")
+	}
+}
+
+// Start runs the pending steps one after another, it never returns.
+func (o *Offboarder) Start() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		steps, err := o.store.ClaimOffboardingSteps(16, offboardingLease)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to claim offboarding steps")
+		}
+
+		for _, s := range steps {
+			o.run(s)
+		}
+
+		if len(steps) == 0 {
+			select {
+			case <-ticker.C:
+			case <-o.wake:
+			}
+		}
+	}
+}
+
+func (o *Offboarder) handleList(c echo.Context) error {
+	steps, err := o.store.ListOffboardingSteps()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, steps)
+}
+
+func (o *Offboarder) handleSchedule(c echo.Context) error {
+	var err error
+	switch action := c.Param("action"); action {
+	case OffboardingOffboard:
+		err = o.Offboard(c.Param("user_id"))
+	case OffboardingReboard:
+		err = o.Reboard(c.Param("user_id"))
+	default:
+		return c.String(http.StatusBadRequest, "unknown action "+action)
+	}
+
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusAccepted)
+}
@@ -1,27 +1,35 @@
 package in
 
 import (
-	"database/sql"
 	"errors"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
 	"github.com/lakelink/auth-companion/out"
+	"github.com/rs/zerolog/log"
 )
 
 type OpenWebUiEnsureTokenRequest struct {
-	OidcUserId string `json:"oidc_user_id"`
-	TokenName  string `json:"token_name"`
-	TokenGroup string `json:"token_group"`
+	OidcUserId      string `json:"oidc_user_id"`
+	OpenWebUiUserId string `json:"openwebui_user_id,omitempty"`
+	TokenName       string `json:"token_name"`
+	TokenGroup      string `json:"token_group"`
 }
 
 type OpenWebUiHandler struct {
-	newApiActor *out.NewApiActor
+	newApiActor  *out.NewApiActor
+	zitadelActor *out.ZitadelActor
+	store        *out.Store
 }
 
-func SetupOpenWebUiEndpoints(g *echo.Group, newApiActor *out.NewApiActor) {
-	h := OpenWebUiHandler{newApiActor}
+func SetupOpenWebUiEndpoints(g *echo.Group, newApiActor *out.NewApiActor, zitadelActor *out.ZitadelActor, store *out.Store, authenticator *OpenWebUiAuthenticator) {
+	h := OpenWebUiHandler{newApiActor, zitadelActor, store}
+	g.Use(authenticator.Middleware())
 	g.POST("/ensure_token", h.handleEnsureToken)
+	g.GET("/tokens", h.handleListTokens)
+	g.POST("/tokens/:id/rotate", h.handleRotateToken)
+	g.DELETE("/tokens/:id", h.handleRevokeToken)
+	g.GET("/balance", h.handleBalance)
 }
 
 func (h *OpenWebUiHandler) handleEnsureToken(c echo.Context) error {
@@ -31,8 +39,26 @@ func (h *OpenWebUiHandler) handleEnsureToken(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "bad request")
 	}
 
+	if !authorizeSubject(c, req.OidcUserId) {
+		log.Warn().Str("oidc_user_id", req.OidcUserId).Msg("token subject does not match oidc_user_id")
+		return c.String(http.StatusForbidden, "forbidden")
+	}
+
+	if req.OpenWebUiUserId != "" && req.OidcUserId != "" {
+		err = h.store.LinkIdentity(out.Identity{ZitadelUserId: req.OidcUserId, OpenWebUiUserId: req.OpenWebUiUserId})
+		if err != nil {
+			log.Warn().Err(err).Str("oidc_user_id", req.OidcUserId).Msg("failed to record open webui identity")
+		}
+	}
+
 	resp, err := h.newApiActor.EnsureToken(req.OidcUserId, req.TokenName, req.TokenGroup)
-	if errors.Is(err, sql.ErrNoRows) {
+	if errors.Is(err, out.ErrNewApiUserNotFound) && h.newApiActor.ProvisionEnabled() {
+		if err = h.provisionUser(req.OidcUserId); err == nil {
+			resp, err = h.newApiActor.EnsureToken(req.OidcUserId, req.TokenName, req.TokenGroup)
+		}
+	}
+
+	if errors.Is(err, out.ErrNewApiUserNotFound) {
 		return c.String(http.StatusNotFound, "user not found")
 	} else if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
@@ -40,3 +66,104 @@ func (h *OpenWebUiHandler) handleEnsureToken(c echo.Context) error {
 		return c.JSON(http.StatusOK, resp)
 	}
 }
+
+// provisionUser creates the missing New API user from ZITADEL, a subject
+// unknown to ZITADEL stays a missing user.
+func (h *OpenWebUiHandler) provisionUser(oidcUserId string) error {
+	u, err := h.zitadelActor.GetUser(oidcUserId)
+	if errors.Is(err, out.ErrZitadelUserNotFound) {
+		return out.ErrNewApiUserNotFound
+	} else if err != nil {
+		return err
+	}
+
+	p, err := out.NewApiProfileFromZitadel(u)
+	if err != nil {
+		log.Warn().Err(err).Str("oidc_user_id", oidcUserId).Msg("not provisioning New API user")
+		return out.ErrNewApiUserNotFound
+	}
+
+	_, err = h.newApiActor.ProvisionUser(p)
+	return err
+}
+
+type OpenWebUiTokenRequest struct {
+	OidcUserId string `json:"oidc_user_id" query:"oidc_user_id"`
+	TokenId    int    `param:"id"`
+}
+
+// bindTokenRequest binds and authorizes the request, writing the error
+// response itself when it returns false.
+func (h *OpenWebUiHandler) bindTokenRequest(c echo.Context, req *OpenWebUiTokenRequest) (bool, error) {
+	if err := c.Bind(req); err != nil || req.OidcUserId == "" {
+		return false, c.String(http.StatusBadRequest, "bad request")
+	}
+
+	if !authorizeSubject(c, req.OidcUserId) {
+		log.Warn().Str("oidc_user_id", req.OidcUserId).Msg("token subject does not match oidc_user_id")
+		return false, c.String(http.StatusForbidden, "forbidden")
+	}
+
+	return true, nil
+}
+
+func newApiErrorResponse(c echo.Context, err error) error {
+	if out.IsNewApiNotFound(err) {
+		return c.String(http.StatusNotFound, "not found")
+	} else if errors.Is(err, out.ErrNewApiUnsupported) {
+		return c.String(http.StatusNotImplemented, err.Error())
+	}
+	return c.String(http.StatusInternalServerError, err.Error())
+}
+
+func (h *OpenWebUiHandler) handleListTokens(c echo.Context) error {
+	var req OpenWebUiTokenRequest
+	if ok, err := h.bindTokenRequest(c, &req); !ok {
+		return err
+	}
+
+	tokens, err := h.newApiActor.ListTokens(req.OidcUserId)
+	if err != nil {
+		return newApiErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// handleRotateToken returns the new key, it cannot be retrieved again later.
+func (h *OpenWebUiHandler) handleRotateToken(c echo.Context) error {
+	var req OpenWebUiTokenRequest
+	if ok, err := h.bindTokenRequest(c, &req); !ok {
+		return err
+	}
+
+	resp, err := h.newApiActor.RotateToken(req.OidcUserId, req.TokenId)
+	if err != nil {
+		return newApiErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *OpenWebUiHandler) handleRevokeToken(c echo.Context) error {
+	var req OpenWebUiTokenRequest
+	if ok, err := h.bindTokenRequest(c, &req); !ok {
+		return err
+	}
+
+	if err := h.newApiActor.RevokeToken(req.OidcUserId, req.TokenId); err != nil {
+		return newApiErrorResponse(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *OpenWebUiHandler) handleBalance(c echo.Context) error {
+	var req OpenWebUiTokenRequest
+	if ok, err := h.bindTokenRequest(c, &req); !ok {
+		return err
+	}
+
+	balance, err := h.newApiActor.Balance(req.OidcUserId)
+	if err != nil {
+		return newApiErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, balance)
+}
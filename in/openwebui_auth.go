@@ -0,0 +1,235 @@
+package in
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/zitadel/oidc/v3/pkg/client"
+	"github.com/zitadel/oidc/v3/pkg/client/rp"
+	"github.com/zitadel/oidc/v3/pkg/client/rs"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+const (
+	OpenWebUiAuthNone          = "none"
+	OpenWebUiAuthJwt           = "jwt"
+	OpenWebUiAuthIntrospection = "introspection"
+	OpenWebUiAuthHmac          = "hmac"
+
+	OpenWebUiTimestampHeader = "X-Companion-Timestamp"
+	OpenWebUiSignatureHeader = "X-Companion-Signature"
+
+	// context key of the subject of a verified ZITADEL token
+	openWebUiSubjectKey = "oidc_subject"
+)
+
+// OpenWebUiAuthenticator authenticates callers of /open-webui following
+// openwebui.auth.mode:
+//   - jwt: a ZITADEL JWT (access or ID token) verified against the JWKS
+//   - introspection: any ZITADEL access token, checked by introspection
+//   - hmac: the request signed by the Open WebUI pipe with a shared secret
+//   - none: anyone, it has to be chosen explicitly
+//
+// Without a mode every caller is rejected.
+//
+// With the token modes the caller may only act on its own oidc_user_id.
+type OpenWebUiAuthenticator struct {
+	mode     string
+	issuer   string
+	audience string
+
+	keySet         oidc.KeySet
+	resourceServer rs.ResourceServer
+
+	secret  []byte
+	maxSkew time.Duration
+	seen    *replayCache
+}
+
+func NewOpenWebUiAuthenticator() *OpenWebUiAuthenticator {
+	a := &OpenWebUiAuthenticator{
+		mode:     viper.GetString("openwebui.auth.mode"),
+		issuer:   viper.GetString("openwebui.auth.issuer"),
+		audience: viper.GetString("openwebui.auth.audience"),
+		secret:   []byte(viper.GetString("openwebui.auth.hmac_secret")),
+		maxSkew:  viper.GetDuration("openwebui.auth.max_skew"),
+		seen:     newReplayCache(),
+	}
+	if a.issuer == "" {
+		a.issuer = "https://" + viper.GetString("zitadel.domain")
+	}
+
+	switch a.mode {
+	case "":
+		log.Error().Msg("openwebui.auth.mode is not set, rejecting every /open-webui request until it is jwt, introspection, hmac or none")
+	case OpenWebUiAuthNone:
+		log.Error().Msg("openwebui.auth.mode is none, ANYONE reaching the companion can obtain and revoke API keys of every user")
+	case OpenWebUiAuthJwt:
+		discovery, err := client.Discover(context.Background(), a.issuer, http.DefaultClient)
+		if err != nil {
+			panic(err)
+		}
+		a.keySet = rp.NewRemoteKeySet(http.DefaultClient, discovery.JwksURI)
+	case OpenWebUiAuthIntrospection:
+		var err error
+		a.resourceServer, err = rs.NewResourceServerClientCredentials(
+			context.Background(),
+			a.issuer,
+			viper.GetString("openwebui.auth.client_id"),
+			viper.GetString("openwebui.auth.client_secret"),
+		)
+		if err != nil {
+			panic(err)
+		}
+	case OpenWebUiAuthHmac:
+		if len(a.secret) == 0 {
+			panic("openwebui.auth.hmac_secret is required by openwebui.auth.mode hmac")
+		}
+	default:
+		panic("unknown openwebui.auth.mode " + a.mode)
+	}
+
+	log.Info().Str("mode", a.mode).Msg("open webui authentication configured")
+
+	return a
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	return strings.TrimSpace(token), ok && token != ""
+}
+
+func (a *OpenWebUiAuthenticator) verifyJwt(ctx context.Context, token string) (string, error) {
+	var claims oidc.AccessTokenClaims
+	payload, err := oidc.ParseToken(token, &claims)
+	if err != nil {
+		return "", err
+	}
+	if err := oidc.CheckIssuer(&claims, a.issuer); err != nil {
+		return "", err
+	}
+	if a.audience != "" {
+		if err := oidc.CheckAudience(&claims, a.audience); err != nil {
+			return "", err
+		}
+	}
+	if err := oidc.CheckSignature(ctx, token, payload, &claims, nil, a.keySet); err != nil {
+		return "", err
+	}
+	if err := oidc.CheckExpiration(&claims, 0); err != nil {
+		return "", err
+	}
+	return claims.GetSubject(), nil
+}
+
+func (a *OpenWebUiAuthenticator) introspect(ctx context.Context, token string) (string, error) {
+	resp, err := rs.Introspect[*oidc.IntrospectionResponse](ctx, a.resourceServer, token)
+	if err != nil {
+		return "", err
+	}
+	if !resp.Active {
+		return "", errors.New("token is not active")
+	}
+	return resp.Subject, nil
+}
+
+// openWebUiSigningString is what the HMAC covers, the request target is
+// part of it as GET and DELETE requests carry the user or token there.
+func openWebUiSigningString(timestamp int64, method, path, rawQuery string, body []byte) []byte {
+	s := strconv.FormatInt(timestamp, 10) + "\n" + method + "\n" + path + "\n" + rawQuery + "\n"
+	return append([]byte(s), body...)
+}
+
+// verifyHmac checks the hex HMAC-SHA256 of
+// "<timestamp>\n<method>\n<escaped path>\n<raw query>\n<body>", the body is
+// put back for the handler. A signature is accepted once within max_skew.
+func (a *OpenWebUiAuthenticator) verifyHmac(c echo.Context) error {
+	timestamp, err := strconv.ParseInt(c.Request().Header.Get(OpenWebUiTimestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("missing or malformed timestamp")
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)).Abs(); skew > a.maxSkew {
+		return errors.New("timestamp outside of openwebui.auth.max_skew")
+	}
+
+	signature, err := hex.DecodeString(c.Request().Header.Get(OpenWebUiSignatureHeader))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+	req := c.Request()
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(openWebUiSigningString(timestamp, req.Method, req.URL.EscapedPath(), req.URL.RawQuery, body))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+
+	_, err = a.seen.add([sha256.Size]byte(signature), timestamp+int64(a.maxSkew/time.Second)+1)
+	return err
+}
+
+func (a *OpenWebUiAuthenticator) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var err error
+			switch a.mode {
+			case OpenWebUiAuthNone:
+				return next(c)
+			case OpenWebUiAuthHmac:
+				err = a.verifyHmac(c)
+			case "":
+				err = errors.New("openwebui.auth.mode not set")
+			case OpenWebUiAuthJwt, OpenWebUiAuthIntrospection:
+				token, ok := bearerToken(c)
+				if !ok {
+					err = errors.New("missing bearer token")
+					break
+				}
+
+				var sub string
+				if a.mode == OpenWebUiAuthJwt {
+					sub, err = a.verifyJwt(c.Request().Context(), token)
+				} else {
+					sub, err = a.introspect(c.Request().Context(), token)
+				}
+				if err == nil {
+					c.Set(openWebUiSubjectKey, sub)
+				}
+			}
+
+			if err != nil {
+				log.Warn().Err(err).Str("mode", a.mode).Str("remote_ip", c.RealIP()).Msg("rejected open webui caller")
+				return c.String(http.StatusUnauthorized, "unauthorized")
+			}
+			return next(c)
+		}
+	}
+}
+
+// authorizeSubject reports whether the caller may act on the OIDC user, only
+// token callers are restricted to themselves.
+func authorizeSubject(c echo.Context, oidcUserId string) bool {
+	sub, ok := c.Get(openWebUiSubjectKey).(string)
+	if !ok {
+		return true
+	}
+	return sub != "" && sub == oidcUserId
+}
@@ -0,0 +1,39 @@
+package in
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestOpenWebUiHmacReplay(t *testing.T) {
+	a := &OpenWebUiAuthenticator{mode: OpenWebUiAuthHmac, secret: []byte("secret"), maxSkew: time.Minute, seen: newReplayCache()}
+
+	timestamp := time.Now().Unix()
+	body := `{"oidc_user_id":"alice"}`
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(openWebUiSigningString(timestamp, http.MethodPost, "/open-webui/token", "", []byte(body)))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	request := func() echo.Context {
+		req := httptest.NewRequest(http.MethodPost, "/open-webui/token", strings.NewReader(body))
+		req.Header.Set(OpenWebUiTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(OpenWebUiSignatureHeader, signature)
+		return echo.New().NewContext(req, httptest.NewRecorder())
+	}
+
+	if err := a.verifyHmac(request()); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := a.verifyHmac(request()); err == nil {
+		t.Error("replayed request was accepted")
+	}
+}
@@ -0,0 +1,228 @@
+package in
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/out"
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
+	"github.com/rs/zerolog/log"
+	user "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/user/v2"
+)
+
+type ReconcileAction string
+
+const (
+	ReconcileAdd        ReconcileAction = "add"
+	ReconcileUpdate     ReconcileAction = "update"
+	ReconcileDeactivate ReconcileAction = "deactivate"
+	ReconcileReactivate ReconcileAction = "reactivate"
+)
+
+type ReconcileItem struct {
+	Action ReconcileAction `json:"action"`
+	Email  string          `json:"email"`
+	UserId string          `json:"user_id,omitempty"`
+	Error  string          `json:"error,omitempty"`
+
+	feishu *larkcontact.UserEvent
+}
+
+type ReconcileReport struct {
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+	DryRun     bool                  `json:"dry_run"`
+	Items      []*ReconcileItem      `json:"items"`
+	Plan       []out.ZitadelPlanStep `json:"plan,omitempty"`
+	Error      string                `json:"error,omitempty"`
+}
+
+// Reconciler compares the whole feishu contact list with ZITADEL and repairs
+// whatever the event handler missed, e.g. while the websocket was down.
+type Reconciler struct {
+	feishuActor  *out.FeishuActor
+	zitadelActor *out.ZitadelActor
+	offboarder   *Offboarder
+
+	mu   sync.Mutex
+	last *ReconcileReport
+}
+
+func NewReconciler(feishuActor *out.FeishuActor, zitadelActor *out.ZitadelActor, offboarder *Offboarder) *Reconciler {
+	return &Reconciler{feishuActor: feishuActor, zitadelActor: zitadelActor, offboarder: offboarder}
+}
+
+// Diff computes the actions needed to bring ZITADEL in line with feishu
+// without changing anything.
+func (r *Reconciler) Diff() ([]*ReconcileItem, error) {
+	feishuUsers, err := r.feishuActor.ListContactUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	zitadelUsers, err := r.zitadelActor.ListHumanUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[string]*user.User{}
+	byEmail := map[string]*user.User{}
+	for _, u := range zitadelUsers {
+		byId[u.GetUserId()] = u
+		byEmail[strings.ToLower(u.GetUsername())] = u
+		if email := u.GetHuman().GetEmail().GetEmail(); email != "" {
+			byEmail[strings.ToLower(email)] = u
+		}
+	}
+
+	items := []*ReconcileItem{}
+	matched := map[string]bool{}
+	for _, e := range feishuUsers {
+		var u *user.User
+		if e.UnionId != nil {
+			userId, linked, err := r.zitadelActor.LookupFeishuIdpLink(*e.UnionId)
+			if err != nil {
+				return nil, err
+			}
+			if linked {
+				u = byId[userId]
+			}
+		}
+		if u == nil && e.EnterpriseEmail != nil && *e.EnterpriseEmail != "" {
+			u = byEmail[strings.ToLower(*e.EnterpriseEmail)]
+		}
+		// still in feishu, so not an orphan even if its profile is incomplete
+		if u != nil {
+			matched[u.GetUserId()] = true
+		}
+
+		if r.zitadelActor.PreflightFeishuUserEvent(e) != nil {
+			log.Warn().Any("open_id", e.OpenId).Msg("incomplete feishu user profile, skipping reconciliation")
+			continue
+		}
+
+		email := *e.EnterpriseEmail
+		active := isFeishuUserActive(e.Status)
+
+		if u == nil {
+			if active {
+				items = append(items, &ReconcileItem{Action: ReconcileAdd, Email: email, feishu: e})
+			}
+			continue
+		}
+
+		if r.zitadelActor.IsUserStale(u, e) {
+			items = append(items, &ReconcileItem{Action: ReconcileUpdate, Email: email, UserId: u.GetUserId(), feishu: e})
+		}
+
+		switch {
+		case active && u.GetState() == user.UserState_USER_STATE_INACTIVE:
+			items = append(items, &ReconcileItem{Action: ReconcileReactivate, Email: email, UserId: u.GetUserId()})
+		case !active && u.GetState() == user.UserState_USER_STATE_ACTIVE:
+			items = append(items, &ReconcileItem{Action: ReconcileDeactivate, Email: email, UserId: u.GetUserId()})
+		}
+	}
+
+	// users that left feishu entirely no longer show up in the contact list,
+	// only touch the ones we created through the feishu IdP
+	for _, u := range zitadelUsers {
+		if matched[u.GetUserId()] || u.GetState() != user.UserState_USER_STATE_ACTIVE {
+			continue
+		}
+
+		linked, err := r.zitadelActor.HasFeishuIdpLink(u.GetUserId())
+		if err != nil {
+			return nil, err
+		}
+		if linked {
+			items = append(items, &ReconcileItem{Action: ReconcileDeactivate, Email: u.GetUsername(), UserId: u.GetUserId()})
+		}
+	}
+
+	return items, nil
+}
+
+func (r *Reconciler) apply(actor *out.ZitadelActor, item *ReconcileItem) error {
+	switch item.Action {
+	case ReconcileAdd:
+		_, userId, err := actor.AddUserFromFeishu(item.feishu)
+		item.UserId = userId
+		return err
+	case ReconcileUpdate:
+		_, _, err := actor.UpdateUserFromFeishu(item.feishu)
+		return err
+	case ReconcileDeactivate:
+		if actor == r.zitadelActor {
+			return r.offboarder.Offboard(item.UserId)
+		}
+		return actor.DeactivateUser(item.UserId)
+	case ReconcileReactivate:
+		if actor == r.zitadelActor {
+			return r.offboarder.Reboard(item.UserId)
+		}
+		return actor.ReactivateUser(item.UserId)
+	}
+	return nil
+}
+
+// Run computes the diff and applies it. Only one run happens at a time. A dry
+// run only records the ZITADEL mutations into the report's plan, its own even
+// if zitadel.dry_run is set and the actor records into the global plan.
+func (r *Reconciler) Run(dryRun bool) *ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	actor := r.zitadelActor
+	if dryRun {
+		actor = actor.DryRun()
+	}
+
+	report := &ReconcileReport{StartedAt: time.Now(), DryRun: actor.IsDryRun(), Items: []*ReconcileItem{}}
+
+	items, err := r.Diff()
+	if err != nil {
+		log.Error().Err(err).Msg("reconciliation failed")
+		report.Error = err.Error()
+	}
+
+	for _, item := range items {
+		if err := r.apply(actor, item); err != nil {
+			item.Error = err.Error()
+		}
+		log.Info().Str("action", string(item.Action)).Str("email", item.Email).Str("userId", item.UserId).Str("error", item.Error).Msg("reconciled user")
+		report.Items = append(report.Items, item)
+	}
+
+	report.FinishedAt = time.Now()
+	if actor != r.zitadelActor {
+		report.Plan = actor.Plan().Steps()
+	} else {
+		r.last = report
+	}
+
+	log.Info().Bool("dryRun", report.DryRun).Int("changes", len(report.Items)).Dur("took", report.FinishedAt.Sub(report.StartedAt)).Msg("reconciliation finished")
+
+	return report
+}
+
+func (r *Reconciler) LastReport() *ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+func (r *Reconciler) handleRun(c echo.Context) error {
+	dryRun := c.QueryParam("dry_run") == "true"
+	return c.JSON(http.StatusOK, r.Run(dryRun))
+}
+
+func (r *Reconciler) handleLastReport(c echo.Context) error {
+	report := r.LastReport()
+	if report == nil {
+		return c.String(http.StatusNotFound, "no reconciliation has run yet")
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,414 @@
+package in
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/misc"
+	"github.com/lakelink/auth-companion/out"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// a report is still sent this long after it was due, e.g. after a restart
+const reportGracePeriod = 24 * time.Hour
+
+// reportMaxBackoff bounds the wait before a failed report is sent again
+const reportMaxBackoff = time.Hour
+
+// reportComplete is the recipient recorded once every delivery of a report
+// succeeded, so it is not rendered again
+const reportComplete = "*"
+
+type reportSchedule struct {
+	misc.ReportConfig
+	weekday time.Weekday
+	hour    int
+	minute  int
+
+	// serialises send, which both Start and handleRun call
+	mu sync.Mutex
+}
+
+// Reporter sends the New API usage of the last period to each user and a
+// team summary to the admins, as scheduled by report.schedules. Deliveries
+// are recorded, so every recipient gets each report once, and a report is
+// rendered again only while some delivery has not succeeded, backing off.
+type Reporter struct {
+	newApiActor *out.NewApiActor
+	feishuActor *out.FeishuActor
+	store       *out.Store
+
+	schedules    map[string]*reportSchedule
+	loc          *time.Location
+	quotaPerUnit float64
+}
+
+func parseReportSchedule(c misc.ReportConfig) (*reportSchedule, error) {
+	s := &reportSchedule{ReportConfig: c, weekday: -1}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), c.Weekday) {
+			s.weekday = d
+		}
+	}
+	if s.weekday < 0 {
+		return nil, errors.New("unknown weekday " + c.Weekday)
+	}
+
+	t, err := time.Parse("15:04", c.Time)
+	if err != nil {
+		return nil, err
+	}
+	s.hour, s.minute = t.Hour(), t.Minute()
+
+	if s.Days <= 0 {
+		s.Days = 7
+	}
+	return s, nil
+}
+
+// reportLocation is report.timezone, or UTC when it does not load.
+func reportLocation() *time.Location {
+	loc, err := time.LoadLocation(viper.GetString("report.timezone"))
+	if err != nil {
+		log.Error().Err(err).Str("timezone", viper.GetString("report.timezone")).Msg("invalid report.timezone, using UTC")
+		return time.UTC
+	}
+	return loc
+}
+
+func NewReporter(newApiActor *out.NewApiActor, feishuActor *out.FeishuActor, store *out.Store) *Reporter {
+	loc := reportLocation()
+
+	var configs []misc.ReportConfig
+	if err := viper.UnmarshalKey("report.schedules", &configs); err != nil {
+		log.Error().Err(err).Msg("invalid report.schedules")
+	}
+
+	schedules := map[string]*reportSchedule{}
+	for _, c := range configs {
+		s, err := parseReportSchedule(c)
+		if err != nil {
+			log.Error().Err(err).Str("report", c.Name).Msg("invalid report schedule, skipping")
+			continue
+		}
+		schedules[c.Name] = s
+	}
+
+	return &Reporter{
+		newApiActor:  newApiActor,
+		feishuActor:  feishuActor,
+		store:        store,
+		schedules:    schedules,
+		loc:          loc,
+		quotaPerUnit: viper.GetFloat64("report.quota_per_unit"),
+	}
+}
+
+// periodEnd is the latest time the report was due at, not after now.
+func (r *Reporter) periodEnd(s *reportSchedule, now time.Time) time.Time {
+	now = now.In(r.loc)
+	end := time.Date(now.Year(), now.Month(), now.Day(), s.hour, s.minute, 0, 0, r.loc)
+	for end.Weekday() != s.weekday || end.After(now) {
+		end = end.AddDate(0, 0, -1)
+	}
+	return end
+}
+
+func (r *Reporter) Start() {
+	if len(r.schedules) == 0 {
+		log.Info().Msg("no usage reports scheduled")
+		return
+	}
+
+	// failed reports by name, waiting for their next attempt
+	retries := map[string]*reportRetry{}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, s := range r.schedules {
+			if !s.Users && len(s.Admins) == 0 {
+				continue
+			}
+			end := r.periodEnd(s, now)
+			if now.Sub(end) > reportGracePeriod {
+				continue
+			}
+
+			complete, err := r.store.ReportDelivered(s.Name, end, reportComplete)
+			if err != nil {
+				log.Error().Err(err).Str("report", s.Name).Msg("failed to check usage report deliveries")
+				continue
+			} else if complete {
+				continue
+			}
+
+			retry := retries[s.Name]
+			if retry != nil && retry.end.Equal(end) && now.Before(retry.at) {
+				continue
+			}
+
+			if err := r.send(s, end); err != nil {
+				if retry == nil || !retry.end.Equal(end) {
+					retry = &reportRetry{end: end}
+					retries[s.Name] = retry
+				}
+				retry.failures++
+				backoff := min(time.Minute<<min(retry.failures, 6), reportMaxBackoff)
+				retry.at = now.Add(backoff)
+				log.Error().Err(err).Str("report", s.Name).Time("period_end", end).Dur("retry_in", backoff).Msg("failed to send usage report")
+			} else {
+				delete(retries, s.Name)
+			}
+		}
+
+		if err := r.store.PruneReportDeliveries(30 * 24 * time.Hour); err != nil {
+			log.Warn().Err(err).Msg("failed to prune report deliveries")
+		}
+	}
+}
+
+// reportRetry backs off a report whose period ending at end failed.
+type reportRetry struct {
+	end      time.Time
+	failures int
+	at       time.Time
+}
+
+// reportDelivery is one message of a report.
+type reportDelivery struct {
+	receiveIdType string
+	receiveId     string
+	text          string
+}
+
+func (r *Reporter) deliveries(s *reportSchedule, end time.Time) ([]reportDelivery, error) {
+	// whole days before the day the report is due
+	until := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, r.loc)
+	since := until.AddDate(0, 0, -s.Days)
+	usage, err := r.newApiActor.Usage(since, until, r.loc)
+	if err != nil {
+		return nil, err
+	}
+
+	period := since.Format(time.DateOnly) + " – " + until.AddDate(0, 0, -1).Format(time.DateOnly)
+	deliveries := []reportDelivery{}
+
+	if s.Users {
+		byUser := map[int][]*out.NewApiUsage{}
+		for _, u := range usage {
+			byUser[u.UserId] = append(byUser[u.UserId], u)
+		}
+		for userId, u := range byUser {
+			receiveIdType, receiveId, ok := r.feishuRecipient(userId)
+			if !ok {
+				log.Warn().Int("user_id", userId).Str("username", u[0].Username).Msg("no feishu recipient for New API user, skipping report")
+				continue
+			}
+			deliveries = append(deliveries, reportDelivery{receiveIdType, receiveId, r.userReport(period, u)})
+		}
+	}
+
+	if len(s.Admins) > 0 {
+		summary := r.summaryReport(period, usage)
+		for _, admin := range s.Admins {
+			receiveIdType, receiveId, ok := strings.Cut(admin, ":")
+			if !ok {
+				log.Error().Str("admin", admin).Msg("incorrect report admin, missing receive_id_type or receive_id")
+				continue
+			}
+			deliveries = append(deliveries, reportDelivery{receiveIdType, receiveId, summary})
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (r *Reporter) send(s *reportSchedule, end time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries, err := r.deliveries(s, end)
+	if err != nil {
+		return err
+	}
+
+	sent, failed := 0, 0
+	for _, d := range deliveries {
+		recipient := d.receiveIdType + ":" + d.receiveId
+		delivered, err := r.store.ReportDelivered(s.Name, end, recipient)
+		if err != nil {
+			return err
+		}
+		if delivered {
+			continue
+		}
+
+		if err := r.feishuActor.SendTextMessage(d.receiveIdType, d.receiveId, d.text); err != nil {
+			log.Error().Err(err).Str("report", s.Name).Str("recipient", recipient).Msg("failed to send usage report")
+			failed++
+			continue
+		}
+		if err := r.store.MarkReportDelivered(s.Name, end, recipient); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		log.Info().Str("report", s.Name).Time("period_end", end).Int("sent", sent).Msg("usage report sent")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deliveries failed", failed, len(deliveries))
+	}
+	return r.store.MarkReportDelivered(s.Name, end, reportComplete)
+}
+
+// feishuRecipient finds the feishu user of a New API user through the
+// identity store, by open_id or else by email.
+func (r *Reporter) feishuRecipient(newApiUserId int) (string, string, bool) {
+	i, err := r.store.LookupIdentity(strconv.Itoa(newApiUserId))
+	if err != nil || i.NewApiUserId != newApiUserId {
+		return "", "", false
+	}
+	if i.FeishuOpenId != "" {
+		return "open_id", i.FeishuOpenId, true
+	}
+	if i.Email != "" {
+		return "email", i.Email, true
+	}
+	return "", "", false
+}
+
+// reportTotal sums usage under a label.
+type reportTotal struct {
+	label    string
+	requests int64
+	quota    int64
+	tokens   int64
+}
+
+func sumUsage(usage []*out.NewApiUsage, label func(*out.NewApiUsage) string) []*reportTotal {
+	totals := map[string]*reportTotal{}
+	for _, u := range usage {
+		l := label(u)
+		t, ok := totals[l]
+		if !ok {
+			t = &reportTotal{label: l}
+			totals[l] = t
+		}
+		t.requests += u.Requests
+		t.quota += u.Quota
+		t.tokens += u.PromptTokens + u.CompletionTokens
+	}
+
+	result := make([]*reportTotal, 0, len(totals))
+	for _, t := range totals {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].quota != result[j].quota {
+			return result[i].quota > result[j].quota
+		}
+		return result[i].label < result[j].label
+	})
+	return result
+}
+
+func (r *Reporter) formatTotal(t *reportTotal) string {
+	return fmt.Sprintf("$%.2f, %d requests, %s tokens", float64(t.quota)/r.quotaPerUnit, t.requests, formatCount(t.tokens))
+}
+
+func formatCount(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1_000_000)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fK", float64(n)/1_000)
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+}
+
+func (r *Reporter) writeTotals(b *strings.Builder, title string, totals []*reportTotal) {
+	b.WriteString("\n" + title + ":\n")
+	for _, t := range totals {
+		b.WriteString("  " + t.label + ": " + r.formatTotal(t) + "\n")
+	}
+}
+
+func (r *Reporter) userReport(period string, usage []*out.NewApiUsage) string {
+	var b strings.Builder
+	b.WriteString("Your AI usage " + period + "\n")
+	b.WriteString("Total: " + r.formatTotal(sumUsage(usage, func(*out.NewApiUsage) string { return "" })[0]) + "\n")
+	r.writeTotals(&b, "By model", sumUsage(usage, func(u *out.NewApiUsage) string { return u.ModelName }))
+
+	byDay := sumUsage(usage, func(u *out.NewApiUsage) string { return u.Day })
+	sort.Slice(byDay, func(i, j int) bool { return byDay[i].label < byDay[j].label })
+	r.writeTotals(&b, "By day", byDay)
+	return strings.TrimSpace(b.String())
+}
+
+func (r *Reporter) summaryReport(period string, usage []*out.NewApiUsage) string {
+	var b strings.Builder
+	b.WriteString("Team AI usage " + period + "\n")
+	if len(usage) == 0 {
+		b.WriteString("No requests.")
+		return b.String()
+	}
+
+	b.WriteString("Total: " + r.formatTotal(sumUsage(usage, func(*out.NewApiUsage) string { return "" })[0]) + "\n")
+	users := sumUsage(usage, func(u *out.NewApiUsage) string { return u.Username })
+	b.WriteString(fmt.Sprintf("Active users: %d\n", len(users)))
+	r.writeTotals(&b, "By user", users)
+	r.writeTotals(&b, "By model", sumUsage(usage, func(u *out.NewApiUsage) string { return u.ModelName }))
+	return strings.TrimSpace(b.String())
+}
+
+func (r *Reporter) schedule(c echo.Context) (*reportSchedule, time.Time, bool) {
+	s, ok := r.schedules[c.Param("name")]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return s, r.periodEnd(s, time.Now()), true
+}
+
+// handlePreview renders the report of the last period without sending it.
+func (r *Reporter) handlePreview(c echo.Context) error {
+	s, end, ok := r.schedule(c)
+	if !ok {
+		return c.String(http.StatusNotFound, "unknown report")
+	}
+
+	deliveries, err := r.deliveries(s, end)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	preview := []map[string]string{}
+	for _, d := range deliveries {
+		preview = append(preview, map[string]string{"recipient": d.receiveIdType + ":" + d.receiveId, "text": d.text})
+	}
+	return c.JSON(http.StatusOK, preview)
+}
+
+// handleRun sends the report of the last period to whoever did not get it.
+func (r *Reporter) handleRun(c echo.Context) error {
+	s, end, ok := r.schedule(c)
+	if !ok {
+		return c.String(http.StatusNotFound, "unknown report")
+	}
+
+	if err := r.send(s, end); err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lakelink/auth-companion/out"
 )
 
 type FeishuUserInfoResponse struct {
@@ -29,8 +30,29 @@ type FeishuUserInfoResponse struct {
 	Msg string `json:"msg"`
 }
 
-func SetupZitadelEndpoints(g *echo.Group) {
+type ZitadelHandler struct {
+	zitadelActor *out.ZitadelActor
+}
+
+func SetupZitadelEndpoints(g *echo.Group, zitadelActor *out.ZitadelActor, reconciler *Reconciler, offboarder *Offboarder, admin echo.MiddlewareFunc) {
+	h := ZitadelHandler{zitadelActor}
 	g.GET("/feishu/user_info", handleFeishuUserInfo)
+	g.POST("/reconcile", reconciler.handleRun, admin)
+	g.GET("/reconcile", reconciler.handleLastReport, admin)
+	g.GET("/plan", h.handlePlan, admin)
+	g.DELETE("/plan", h.handleResetPlan, admin)
+	g.GET("/offboarding", offboarder.handleList, admin)
+	g.POST("/offboarding/:user_id/:action", offboarder.handleSchedule, admin)
+}
+
+// handlePlan returns the mutations recorded while zitadel.dry_run is enabled
+func (h *ZitadelHandler) handlePlan(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.zitadelActor.Plan().Steps())
+}
+
+func (h *ZitadelHandler) handleResetPlan(c echo.Context) error {
+	h.zitadelActor.Plan().Reset()
+	return c.NoContent(http.StatusNoContent)
 }
 
 func handleFeishuUserInfo(c echo.Context) error {
@@ -3,14 +3,109 @@ package misc
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+// NotificationDstConfig sends notifications to Dst of the sink Actor, see
+// out.NewNotificationSink. Format is "text" or "card" for the feishu sinks,
+// DstSecret signs what feishu_bot and http sinks send.
+type NotificationDstConfig struct {
+	Actor     string
+	Dst       string
+	Format    string
+	DstSecret string
+}
+
+// NewApiWebhookConfig accepts the notifications New API posts to
+// /newapi/notification/Src. Those no NewApiRouteConfig matches go to Dst of
+// the sink Actor, the source's default route; without an Actor they are
+// dropped. Template renders their content, see NewApiRouteConfig.
+//
+// Secret is the webhook secret set in New API, which then signs what it
+// posts. AllowedIps (addresses or CIDRs) restricts who may post, and a
+// MaxSkew rejects payloads whose timestamp is further off, or that were
+// already received.
 type NewApiWebhookConfig struct {
-	Src   string
-	Actor string
-	Dst   string
+	Src       string
+	Actor     string
+	Dst       string
+	Format    string
+	DstSecret string
+
+	Secret     string
+	AllowedIps []string
+	MaxSkew    time.Duration
+	Template   string
+}
+
+// DefaultDst is the default route of the source.
+func (c NewApiWebhookConfig) DefaultDst() NotificationDstConfig {
+	return NotificationDstConfig{c.Actor, c.Dst, c.Format, c.DstSecret}
+}
+
+// NewApiRouteConfig sends the notifications of the source Src, or of every
+// source if empty, to all of Dsts. A notification matches if its type is
+// one of Types, its title matches the regexp Title and one of its values
+// matches the regexp Value, an empty condition matches anything.
+//
+// Routes are tried in order and the first that matches is taken, unless it
+// has Continue set, then the following ones are tried as well.
+//
+// Template is a text/template rendering the content the route sends, e.g.
+// "{{.Message}}" (the content as New API sent it), see in.newApiTemplateData
+// and in.newApiTemplateFuncs. Empty sends the content as is.
+type NewApiRouteConfig struct {
+	Name     string
+	Src      string
+	Types    []string
+	Title    string
+	Value    string
+	Dsts     []NotificationDstConfig
+	Continue bool
+	Template string
+}
+
+// NewApiTokenPolicyConfig shapes every token of the token_group Group. A zero
+// Quota is unlimited, a zero Expiry never expires, empty Models and Subnets
+// allow everything.
+type NewApiTokenPolicyConfig struct {
+	Group   string
+	Quota   int64
+	Expiry  time.Duration
+	Models  []string
+	Subnets []string
+}
+
+// ZitadelGrantConfig grants RoleKeys of ProjectId to every member of the
+// feishu department (open_department_id) or user group Id. IncludeChildren
+// only applies to departments.
+type ZitadelGrantConfig struct {
+	Id              string
+	ProjectId       string
+	RoleKeys        []string
+	IncludeChildren bool
+}
+
+// ZitadelMetadataConfig writes the feishu user field at the dotted JSON path
+// Field, e.g. "avatar.avatar_240" or "custom_attrs", to the ZITADEL metadata
+// Key. Strings are written as is, anything else as JSON.
+type ZitadelMetadataConfig struct {
+	Field string
+	Key   string
+}
+
+// ReportConfig sends the New API usage of the Days days before every Weekday
+// at Time ("15:04" in report.timezone). Users sends each user their own
+// usage, Admins ("receive_id_type:receive_id") get the team summary.
+type ReportConfig struct {
+	Name    string
+	Weekday string
+	Time    string
+	Days    int
+	Users   bool
+	Admins  []string
 }
 
 func SetupConfig() {
@@ -21,25 +116,106 @@ func SetupConfig() {
 
 	// Set defaults optionally
 	viper.SetDefault("listen_addr", ":1323")
+	// proxies (CIDRs) whose X-Forwarded-For is believed, empty trusts none
+	// and uses the peer address
+	viper.SetDefault("trusted_proxies", []string{})
+	// bearer token of the admin endpoints, empty disables them
+	viper.SetDefault("admin.token", "")
 
 	viper.SetDefault("log.console", true)
 	viper.SetDefault("log.path", "auth_companion.log")
 
+	viper.SetDefault("store.db_path", "auth_companion.db")
+
+	// db writes New API's tables, api uses its admin HTTP API which cannot manage tokens
+	viper.SetDefault("newapi.mode", "db")
+	viper.SetDefault("newapi.api.base_url", "")
+	viper.SetDefault("newapi.api.access_token", "") // system access token of an admin
+	viper.SetDefault("newapi.api.user_id", 0)       // the admin's user ID, sent as New-Api-User
+
+	viper.SetDefault("newapi.sql_dsn", "") // New API's SQL_DSN, empty for SQLite at db_path
 	viper.SetDefault("newapi.db_path", "one-api.db")
+	viper.SetDefault("newapi.token_policies", []NewApiTokenPolicyConfig{})
+
+	// create missing New API users from their ZITADEL profile on ensure_token
+	viper.SetDefault("newapi.provision.enabled", false)
+	viper.SetDefault("newapi.provision.group", "default")
+	viper.SetDefault("newapi.provision.quota", 0)
+
 	viper.SetDefault("newapi.webhooks", []NewApiWebhookConfig{
 		{
-			"default", "feishu", "open_id:ou_7d8a6e6df7621556ce0d21922b676706ccs",
+			Src:     "default",
+			Actor:   "feishu",
+			Dst:     "open_id:ou_7d8a6e6df7621556ce0d21922b676706ccs",
+			Format:  "text",
+			MaxSkew: 5 * time.Minute,
 		},
 	})
+	// e.g. quota_exceed of any source to the finance chat, see NewApiRouteConfig
+	viper.SetDefault("newapi.routes", []NewApiRouteConfig{})
+
+	// used by smtp webhook sinks, port 465 is implicit TLS
+	viper.SetDefault("smtp.addr", "")
+	viper.SetDefault("smtp.username", "")
+	viper.SetDefault("smtp.password", "")
+	viper.SetDefault("smtp.from", "")
+
+	// jwt, introspection, hmac or none, see in.OpenWebUiAuthenticator; every
+	// request is rejected until it is set
+	viper.SetDefault("openwebui.auth.mode", "")
+	viper.SetDefault("openwebui.auth.issuer", "") // defaults to https://<zitadel.domain>
+	viper.SetDefault("openwebui.auth.audience", "")
+	viper.SetDefault("openwebui.auth.client_id", "")
+	viper.SetDefault("openwebui.auth.client_secret", "")
+	viper.SetDefault("openwebui.auth.hmac_secret", "")
+	viper.SetDefault("openwebui.auth.max_skew", "5m")
 
 	viper.SetDefault("feishu.app_id", "")
 	viper.SetDefault("feishu.app_secret", "")
 	viper.SetDefault("feishu.verification_token", "")
 	viper.SetDefault("feishu.encrypt_key", "")
+	viper.SetDefault("feishu.inbox.workers", 4)
+	viper.SetDefault("feishu.inbox.max_attempts", 8)
+	viper.SetDefault("feishu.inbox.backoff", "5s")
+	viper.SetDefault("feishu.inbox.max_backoff", "30m")
+	// user group events have no typed handler in the SDK, list the types
+	// subscribed to in the developer console
+	viper.SetDefault("feishu.group_event_types", []string{
+		"contact.group.created_v3",
+		"contact.group.updated_v3",
+		"contact.group.deleted_v3",
+		"contact.group.member_changed_v3",
+	})
 
 	viper.SetDefault("zitadel.domain", "")
 	viper.SetDefault("zitadel.pat", "")
 	viper.SetDefault("zitadel.feishu_idp_id", "")
+	viper.SetDefault("zitadel.dry_run", false)
+	viper.SetDefault("zitadel.department_grants", []ZitadelGrantConfig{})
+	viper.SetDefault("zitadel.group_grants", []ZitadelGrantConfig{})
+	// auto: en_name, falling back to name; en_name; name
+	viper.SetDefault("zitadel.name.strategy", "auto")
+	// text/template over out.FeishuName, an empty nick_name is not synced
+	viper.SetDefault("zitadel.name.display_name", "{{or .EnName .Name}}")
+	viper.SetDefault("zitadel.name.nick_name", "")
+	viper.SetDefault("zitadel.metadata", []ZitadelMetadataConfig{
+		{"avatar.avatar_origin", "feishu:avatar_origin_url"},
+		{"avatar.avatar_240", "feishu:avatar_240_url"},
+	})
+
+	viper.SetDefault("reconcile.interval", "6h") // 0 disables periodic runs
+
+	viper.SetDefault("offboarding.max_attempts", 10)
+	viper.SetDefault("offboarding.backoff", "30s")
+	viper.SetDefault("offboarding.max_backoff", "1h")
+
+	// also used by the date and quota functions of notification templates
+	viper.SetDefault("report.timezone", "Asia/Shanghai")
+	viper.SetDefault("report.quota_per_unit", 500000) // New API's QuotaPerUnit, quota per dollar
+	// set Users or Admins to start sending
+	viper.SetDefault("report.schedules", []ReportConfig{
+		{"weekly", "Monday", "09:00", 7, false, []string{}},
+	})
 
 	// Check if config file exists
 	configFile := "config.toml"
@@ -1,7 +1,12 @@
 import json
+import hmac
+import time
+import hashlib
 import aiohttp
 import logging
 
+from urllib.parse import urlsplit
+
 from typing import Optional
 
 from pydantic import BaseModel, Field
@@ -29,6 +34,21 @@ log = logging.getLogger(__name__)
 log.setLevel(SRC_LOG_LEVELS["OPENAI"])
 
 
+def sign_request(method: str, url: str, req: dict, secret: str) -> tuple[bytes, dict]:
+    """Encodes the request, signed as the companion expects when secret is set."""
+    data = json.dumps(req).encode()
+    headers = {"Content-Type": "application/json"}
+    if secret:
+        timestamp = str(int(time.time()))
+        target = urlsplit(url)
+        signed = "\n".join([timestamp, method, target.path or "/", target.query, ""])
+        headers["X-Companion-Timestamp"] = timestamp
+        headers["X-Companion-Signature"] = hmac.new(
+            secret.encode(), signed.encode() + data, hashlib.sha256
+        ).hexdigest()
+    return data, headers
+
+
 class Pipe:
     class Valves(BaseModel):
         API_BASE_URL: str = Field(
@@ -39,6 +59,10 @@ class Pipe:
             default="http://companion/open-webui/ensure_token",
             description="Base URL for obtaining API token.",
         )
+        API_TOKEN_SECRET: str = Field(
+            default="",
+            description="Shared secret for signing token requests, when the companion uses openwebui.auth.mode hmac.",
+        )
         TOKEN_NAME: str = Field(default="open-webui")
         TOKEN_GROUP: str = Field(default="open-webui")
 
@@ -99,7 +123,7 @@ class Pipe:
             )
 
         oidc_user_id = user.oauth_sub.split("@")[1]
-        status, token = await self.obtain_user_api_key(oidc_user_id)
+        status, token = await self.obtain_user_api_key(oidc_user_id, user.id)
         if status == 404:
             raise HTTPException(
                 status_code=404,
@@ -222,9 +246,10 @@ class Pipe:
                     r.close()
                 await session.close()
 
-    async def obtain_user_api_key(self, oidc_user_id: str) -> str:
+    async def obtain_user_api_key(self, oidc_user_id: str, openwebui_user_id: str = "") -> str:
         req = {
             "oidc_user_id": oidc_user_id,
+            "openwebui_user_id": openwebui_user_id,
             "token_name": self.valves.TOKEN_NAME,
             "token_group": self.valves.TOKEN_GROUP,
         }
@@ -232,7 +257,12 @@ class Pipe:
         async with aiohttp.ClientSession(
             trust_env=True, timeout=aiohttp.ClientTimeout(total=AIOHTTP_CLIENT_TIMEOUT)
         ) as session:
-            async with session.post(url=self.valves.API_TOKEN_URL, json=req) as resp:
+            data, headers = sign_request(
+                "POST", self.valves.API_TOKEN_URL, req, self.valves.API_TOKEN_SECRET
+            )
+            async with session.post(
+                url=self.valves.API_TOKEN_URL, data=data, headers=headers
+            ) as resp:
                 if resp.headers.get("content-type") == "application/json":
                     j = await resp.json()
                     return resp.status, j.get("token", None)
@@ -6,9 +6,14 @@ required_open_webui_version: 0.5.3
 """
 
 import json
+import hmac
+import time
+import hashlib
 import asyncio
 import aiohttp
 
+from urllib.parse import urlencode, urlsplit
+
 from typing import List, Union, Generator, Iterator
 from pydantic import BaseModel, Field
 from typing import Optional
@@ -19,10 +24,32 @@ from open_webui.models.users import Users, UserSettings
 from open_webui.env import AIOHTTP_CLIENT_TIMEOUT
 
 
+def sign_request(
+    method: str, url: str, req: Optional[dict], secret: str
+) -> tuple[bytes, dict]:
+    """Encodes the request, signed as the companion expects when secret is set.
+    A None request is an empty body, as sent with GET. The url must already
+    carry the query string."""
+    data = json.dumps(req).encode() if req is not None else b""
+    headers = {"Content-Type": "application/json"} if req is not None else {}
+    if secret:
+        timestamp = str(int(time.time()))
+        target = urlsplit(url)
+        signed = "\n".join([timestamp, method, target.path or "/", target.query, ""])
+        headers["X-Companion-Timestamp"] = timestamp
+        headers["X-Companion-Signature"] = hmac.new(
+            secret.encode(), signed.encode() + data, hashlib.sha256
+        ).hexdigest()
+    return data, headers
+
+
 class Tools:
     class Valves(BaseModel):
         api_base_url: str = Field(default="https://api.openai.com/v1")
         api_token_url: str = Field(default="https://localhost/newapi/ensure_token")
+        api_token_secret: str = Field(default="")
+        api_balance_url: str = Field(default="https://localhost/open-webui/balance")
+        quota_per_unit: float = Field(default=500000)
         token_name: str = Field(default="open-webui")
         token_group: str = Field(default="open-webui")
         pass
@@ -81,6 +108,56 @@ class Tools:
 
             # return f"Notify the user that the image has been successfully generated"
 
+    async def check_balance(
+        self,
+        __user__: dict,
+        __event_emitter__=None,
+    ) -> str:
+        """
+        Show how much credit the user has left at LakeLink AI Aggregator.
+        """
+        user = Users.get_user_by_id(__user__["id"])
+        if not user.oauth_sub.startswith("oidc@"):
+            return await self.__emit_error__(
+                "You are not registered through LakeLink ZITADEL.",
+                emitter=__event_emitter__,
+            )
+
+        oidc_user_id = user.oauth_sub.split("@")[1]
+        status, balance = await self.__get_balance__(oidc_user_id)
+        if status == 404:
+            return await self.__emit_error__(
+                "User not found at LakeLink AI Aggregator.",
+                notification="Please first login using OIDC at https://ai.lklk.tech.",
+                emitter=__event_emitter__,
+            )
+        elif status != 200:
+            return await self.__emit_error__(
+                f"An error occured while querying the balance: {balance}",
+                emitter=__event_emitter__,
+            )
+
+        unit = self.valves.quota_per_unit
+        lines = [
+            f"Balance: **${balance['quota'] / unit:.2f}**, used ${balance['used_quota'] / unit:.2f} in {balance['request_count']} requests."
+        ]
+        for token in balance.get("tokens") or []:
+            remain = "unlimited" if token["unlimited_quota"] else f"${token['remain_quota'] / unit:.2f}"
+            lines.append(f"- API key {token['name']}: {remain} left, used ${token['used_quota'] / unit:.2f}")
+        return "\n".join(lines)
+
+    async def __get_balance__(self, oidc_user_id: str):
+        async with aiohttp.ClientSession(
+            trust_env=True, timeout=aiohttp.ClientTimeout(total=AIOHTTP_CLIENT_TIMEOUT)
+        ) as session:
+            url = self.valves.api_balance_url + "?" + urlencode({"oidc_user_id": oidc_user_id})
+            _, headers = sign_request("GET", url, None, self.valves.api_token_secret)
+            async with session.get(url=url, headers=headers) as resp:
+                if resp.headers.get('content-type', '').startswith('application/json'):
+                    return resp.status, await resp.json()
+                else:
+                    return resp.status, await resp.text()
+
     async def __execute_enable_model_access__(self, user, __event_emitter__):
         if not user.oauth_sub.startswith("oidc@"):
             return await self.__emit_error__(
@@ -96,7 +173,7 @@ class Tools:
             }
         )
         oidc_user_id = user.oauth_sub.split("@")[1]
-        status, token = await self.__obtain_user_api_token__(oidc_user_id)
+        status, token = await self.__obtain_user_api_token__(oidc_user_id, user.id)
         if status == 404:
             return await self.__emit_error__(
                 "User not found at LakeLink AI Aggregator.",
@@ -143,9 +220,10 @@ class Tools:
 
         return "✅ Please **refresh the page** to access newly enabled models.\nRemember to top-up credit balance at https://ai.lklk.tech."
 
-    async def __obtain_user_api_token__(self, oidc_user_id: str) -> str:
+    async def __obtain_user_api_token__(self, oidc_user_id: str, openwebui_user_id: str = "") -> str:
         req = {
             "oidc_user_id": oidc_user_id,
+            "openwebui_user_id": openwebui_user_id,
             "token_name": self.valves.token_name,
             "token_group": self.valves.token_group,
         }
@@ -153,7 +231,10 @@ class Tools:
         async with aiohttp.ClientSession(
             trust_env=True, timeout=aiohttp.ClientTimeout(total=AIOHTTP_CLIENT_TIMEOUT)
         ) as session:
-            async with session.post(url=self.valves.api_token_url, json=req) as resp:
+            data, headers = sign_request(
+                "POST", self.valves.api_token_url, req, self.valves.api_token_secret
+            )
+            async with session.post(url=self.valves.api_token_url, data=data, headers=headers) as resp:
                 if resp.headers.get('content-type') == 'application/json':
                     j = await resp.json()
                     return resp.status, j.get("token", None)
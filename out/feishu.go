@@ -3,15 +3,26 @@ package out
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 
 	lark "github.com/larksuite/oapi-sdk-go/v3"
 	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
 	larkim "github.com/larksuite/oapi-sdk-go/v3/service/im/v1"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
+// ErrFeishuUserNotFound is returned by GetUser for users that no longer exist
+// in feishu, e.g. deleted after they left.
+var ErrFeishuUserNotFound = errors.New("user not found in feishu")
+
+// feishuUserNotFoundCodes are the error codes feishu answers a lookup of a
+// deleted or invalid open_id with.
+var feishuUserNotFoundCodes = []int{40013, 41012}
+
 type FeishuActor struct {
 	c *lark.Client
 }
@@ -34,12 +45,26 @@ func (a *FeishuActor) SendTextMessage(receiveIdType, receiveId string, text stri
 		return err
 	}
 
+	return a.sendMessage(receiveIdType, receiveId, larkim.MsgTypeText, string(b))
+}
+
+// SendCardMessage sends an interactive message card.
+func (a *FeishuActor) SendCardMessage(receiveIdType, receiveId string, card *FeishuCard) error {
+	b, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+
+	return a.sendMessage(receiveIdType, receiveId, larkim.MsgTypeInteractive, string(b))
+}
+
+func (a *FeishuActor) sendMessage(receiveIdType, receiveId, msgType, content string) error {
 	req := larkim.NewCreateMessageReqBuilder().
 		ReceiveIdType(receiveIdType).
 		Body(larkim.NewCreateMessageReqBodyBuilder().
 			ReceiveId(receiveId).
-			MsgType(`text`).
-			Content(string(b)).
+			MsgType(msgType).
+			Content(content).
 			Build()).
 		Build()
 
@@ -53,7 +78,240 @@ func (a *FeishuActor) SendTextMessage(receiveIdType, receiveId string, text stri
 		return fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
 	}
 
-	log.Info().Str("receive_id_type", receiveIdType).Str("receive_id", receiveId).Msg("feishu message sent")
+	log.Info().Str("receive_id_type", receiveIdType).Str("receive_id", receiveId).Str("msg_type", msgType).Msg("feishu message sent")
 
 	return nil
 }
+
+// ListContactUsers walks the whole department tree visible to the app and
+// returns every user in it, converted into the shape used by contact events.
+func (a *FeishuActor) ListContactUsers() ([]*larkcontact.UserEvent, error) {
+	return a.ListDepartmentUsers("0")
+}
+
+// ListDepartmentAncestors returns the open_department_ids of all parents of
+// the department, nearest first.
+func (a *FeishuActor) ListDepartmentAncestors(departmentId string) ([]string, error) {
+	ancestors := []string{}
+
+	pageToken := ""
+	for {
+		builder := larkcontact.NewParentDepartmentReqBuilder().
+			DepartmentId(departmentId).
+			DepartmentIdType("open_department_id").
+			PageSize(50)
+		if pageToken != "" {
+			builder = builder.PageToken(pageToken)
+		}
+
+		resp, err := a.c.Contact.V3.Department.Parent(context.Background(), builder.Build())
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success() {
+			return nil, fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+		}
+
+		for _, d := range resp.Data.Items {
+			if d.OpenDepartmentId != nil {
+				ancestors = append(ancestors, *d.OpenDepartmentId)
+			}
+		}
+
+		if resp.Data.HasMore == nil || !*resp.Data.HasMore || resp.Data.PageToken == nil {
+			break
+		}
+		pageToken = *resp.Data.PageToken
+	}
+
+	return ancestors, nil
+}
+
+// ListDepartmentUsers returns the users of the department and all of its
+// descendants, "0" being the root.
+func (a *FeishuActor) ListDepartmentUsers(rootDepartmentId string) ([]*larkcontact.UserEvent, error) {
+	departmentIds := []string{rootDepartmentId}
+
+	pageToken := ""
+	for {
+		builder := larkcontact.NewChildrenDepartmentReqBuilder().
+			DepartmentId(rootDepartmentId).
+			DepartmentIdType("open_department_id").
+			FetchChild(true).
+			PageSize(50)
+		if pageToken != "" {
+			builder = builder.PageToken(pageToken)
+		}
+
+		resp, err := a.c.Contact.V3.Department.Children(context.Background(), builder.Build())
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success() {
+			return nil, fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+		}
+
+		for _, d := range resp.Data.Items {
+			if d.OpenDepartmentId != nil {
+				departmentIds = append(departmentIds, *d.OpenDepartmentId)
+			}
+		}
+
+		if resp.Data.HasMore == nil || !*resp.Data.HasMore || resp.Data.PageToken == nil {
+			break
+		}
+		pageToken = *resp.Data.PageToken
+	}
+
+	seen := map[string]bool{}
+	users := []*larkcontact.UserEvent{}
+	for _, departmentId := range departmentIds {
+		pageToken = ""
+		for {
+			builder := larkcontact.NewFindByDepartmentUserReqBuilder().
+				DepartmentId(departmentId).
+				DepartmentIdType("open_department_id").
+				PageSize(50)
+			if pageToken != "" {
+				builder = builder.PageToken(pageToken)
+			}
+
+			resp, err := a.c.Contact.V3.User.FindByDepartment(context.Background(), builder.Build())
+			if err != nil {
+				return nil, err
+			}
+			if !resp.Success() {
+				return nil, fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+			}
+
+			for _, u := range resp.Data.Items {
+				if u.OpenId == nil || seen[*u.OpenId] {
+					continue
+				}
+				seen[*u.OpenId] = true
+
+				e, err := userToUserEvent(u)
+				if err != nil {
+					return nil, err
+				}
+				users = append(users, e)
+			}
+
+			if resp.Data.HasMore == nil || !*resp.Data.HasMore || resp.Data.PageToken == nil {
+				break
+			}
+			pageToken = *resp.Data.PageToken
+		}
+	}
+
+	log.Info().Str("root", rootDepartmentId).Int("departments", len(departmentIds)).Int("users", len(users)).Msg("listed feishu contact users")
+
+	return users, nil
+}
+
+// larkcontact.User and larkcontact.UserEvent share their JSON field names
+func userToUserEvent(u *larkcontact.User) (*larkcontact.UserEvent, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var e larkcontact.UserEvent
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (a *FeishuActor) GetUser(openId string) (*larkcontact.UserEvent, error) {
+	req := larkcontact.NewGetUserReqBuilder().
+		UserId(openId).
+		UserIdType("open_id").
+		Build()
+
+	resp, err := a.c.Contact.V3.User.Get(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(feishuUserNotFoundCodes, resp.Code) {
+		return nil, ErrFeishuUserNotFound
+	}
+	if !resp.Success() {
+		return nil, fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+	}
+
+	return userToUserEvent(resp.Data.User)
+}
+
+// ListUserGroups returns the IDs of the user groups the user is a direct
+// member of.
+func (a *FeishuActor) ListUserGroups(openId string) ([]string, error) {
+	groupIds := []string{}
+
+	pageToken := ""
+	for {
+		builder := larkcontact.NewMemberBelongGroupReqBuilder().
+			MemberId(openId).
+			MemberIdType("open_id").
+			PageSize(100)
+		if pageToken != "" {
+			builder = builder.PageToken(pageToken)
+		}
+
+		resp, err := a.c.Contact.V3.Group.MemberBelong(context.Background(), builder.Build())
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success() {
+			return nil, fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+		}
+
+		groupIds = append(groupIds, resp.Data.GroupList...)
+
+		if resp.Data.HasMore == nil || !*resp.Data.HasMore || resp.Data.PageToken == nil {
+			break
+		}
+		pageToken = *resp.Data.PageToken
+	}
+
+	return groupIds, nil
+}
+
+// ListGroupMembers returns the open_ids of the users in the user group.
+// Departments added to the group as a whole are not expanded.
+func (a *FeishuActor) ListGroupMembers(groupId string) ([]string, error) {
+	openIds := []string{}
+
+	pageToken := ""
+	for {
+		builder := larkcontact.NewSimplelistGroupMemberReqBuilder().
+			GroupId(groupId).
+			MemberIdType("open_id").
+			MemberType("user").
+			PageSize(100)
+		if pageToken != "" {
+			builder = builder.PageToken(pageToken)
+		}
+
+		resp, err := a.c.Contact.V3.GroupMember.Simplelist(context.Background(), builder.Build())
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success() {
+			return nil, fmt.Errorf("logId: %s, error response: \n%s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+		}
+
+		for _, m := range resp.Data.Memberlist {
+			if m.MemberId != nil {
+				openIds = append(openIds, *m.MemberId)
+			}
+		}
+
+		if resp.Data.HasMore == nil || !*resp.Data.HasMore || resp.Data.PageToken == nil {
+			break
+		}
+		pageToken = *resp.Data.PageToken
+	}
+
+	return openIds, nil
+}
@@ -0,0 +1,86 @@
+package out
+
+// FeishuCard is a message card in Feishu's card JSON, only the elements the
+// companion sends are modelled.
+type FeishuCard struct {
+	Config   feishuCardConfig `json:"config"`
+	Header   feishuCardHeader `json:"header"`
+	Elements []map[string]any `json:"elements"`
+}
+
+type feishuCardConfig struct {
+	WideScreenMode bool `json:"wide_screen_mode"`
+}
+
+type feishuCardHeader struct {
+	Template string         `json:"template"`
+	Title    feishuCardText `json:"title"`
+}
+
+type feishuCardText struct {
+	Tag     string `json:"tag"`
+	Content string `json:"content"`
+}
+
+// FeishuCardField is a key/value pair of a card's field section.
+type FeishuCardField struct {
+	Key   string
+	Value string
+}
+
+// NewFeishuCard starts a card, template is the header color: blue, wathet,
+// turquoise, green, yellow, orange, red, carmine, violet, purple, indigo or
+// grey.
+func NewFeishuCard(title, template string) *FeishuCard {
+	return &FeishuCard{
+		Config: feishuCardConfig{WideScreenMode: true},
+		Header: feishuCardHeader{
+			Template: template,
+			Title:    feishuCardText{"plain_text", title},
+		},
+		Elements: []map[string]any{},
+	}
+}
+
+// AddMarkdown adds a block of lark_md text.
+func (c *FeishuCard) AddMarkdown(content string) *FeishuCard {
+	c.Elements = append(c.Elements, map[string]any{
+		"tag":  "div",
+		"text": feishuCardText{"lark_md", content},
+	})
+	return c
+}
+
+// AddFields adds the pairs as a section of short fields, two per row.
+func (c *FeishuCard) AddFields(fields []FeishuCardField) *FeishuCard {
+	if len(fields) == 0 {
+		return c
+	}
+
+	f := []map[string]any{}
+	for _, field := range fields {
+		f = append(f, map[string]any{
+			"is_short": true,
+			"text":     feishuCardText{"lark_md", "**" + field.Key + "**\n" + field.Value},
+		})
+	}
+	c.Elements = append(c.Elements, map[string]any{
+		"tag":    "div",
+		"fields": f,
+	})
+	return c
+}
+
+func (c *FeishuCard) AddDivider() *FeishuCard {
+	c.Elements = append(c.Elements, map[string]any{"tag": "hr"})
+	return c
+}
+
+// AddNote adds grey small print, e.g. where the message came from.
+func (c *FeishuCard) AddNote(content string) *FeishuCard {
+	c.Elements = append(c.Elements, map[string]any{
+		"tag":      "note",
+		"elements": []feishuCardText{{"plain_text", content}},
+	})
+	return c
+}
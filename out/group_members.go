@@ -0,0 +1,43 @@
+package out
+
+// FeishuGroupMembers returns the members of a feishu user group remembered by
+// SetFeishuGroupMembers, so users that left the group can be found again
+// once feishu no longer lists them.
+func (s *Store) FeishuGroupMembers(groupId string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT open_id FROM feishu_group_members WHERE group_id = ?`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var openId string
+		if err := rows.Scan(&openId); err != nil {
+			return nil, err
+		}
+		members = append(members, openId)
+	}
+	return members, rows.Err()
+}
+
+// SetFeishuGroupMembers remembers the current members of a feishu user group.
+func (s *Store) SetFeishuGroupMembers(groupId string, openIds []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM feishu_group_members WHERE group_id = ?`, groupId); err != nil {
+		return err
+	}
+	for _, openId := range openIds {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO feishu_group_members(group_id, open_id) VALUES (?, ?)`, groupId, openId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
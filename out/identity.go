@@ -0,0 +1,197 @@
+package out
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Identity links the IDs one person has across Feishu, ZITADEL, New API and
+// Open WebUI. Zero values mean unknown.
+type Identity struct {
+	FeishuOpenId    string `json:"feishu_open_id,omitempty"`
+	FeishuUnionId   string `json:"feishu_union_id,omitempty"`
+	FeishuUserId    string `json:"feishu_user_id,omitempty"`
+	ZitadelUserId   string `json:"zitadel_user_id,omitempty"`
+	NewApiUserId    int    `json:"newapi_user_id,omitempty"`
+	OpenWebUiUserId string `json:"openwebui_user_id,omitempty"`
+	Email           string `json:"email,omitempty"`
+	UpdatedAt       int64  `json:"updated_at"`
+}
+
+var ErrIdentityNotFound = errors.New("identity not found")
+
+const identityColumns = "id, feishu_open_id, feishu_union_id, feishu_user_id, zitadel_user_id, newapi_user_id, openwebui_user_id, email, updated_at"
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanIdentity(row rowScanner) (int64, *Identity, error) {
+	var id int64
+	var openId, unionId, userId, zitadelId, openWebUiId, email sql.NullString
+	var newApiId sql.NullInt64
+	var updatedAt int64
+
+	err := row.Scan(&id, &openId, &unionId, &userId, &zitadelId, &newApiId, &openWebUiId, &email, &updatedAt)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, &Identity{
+		FeishuOpenId:    openId.String,
+		FeishuUnionId:   unionId.String,
+		FeishuUserId:    userId.String,
+		ZitadelUserId:   zitadelId.String,
+		NewApiUserId:    int(newApiId.Int64),
+		OpenWebUiUserId: openWebUiId.String,
+		Email:           email.String,
+		UpdatedAt:       updatedAt,
+	}, nil
+}
+
+// merge overwrites the fields of i that are set in o
+func (i *Identity) merge(o *Identity) {
+	for _, f := range []struct{ dst, src *string }{
+		{&i.FeishuOpenId, &o.FeishuOpenId},
+		{&i.FeishuUnionId, &o.FeishuUnionId},
+		{&i.FeishuUserId, &o.FeishuUserId},
+		{&i.ZitadelUserId, &o.ZitadelUserId},
+		{&i.OpenWebUiUserId, &o.OpenWebUiUserId},
+		{&i.Email, &o.Email},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if o.NewApiUserId != 0 {
+		i.NewApiUserId = o.NewApiUserId
+	}
+}
+
+// LinkIdentity records that all IDs set in link belong to the same person.
+// Rows sharing any of those IDs are merged into one.
+func (s *Store) LinkIdentity(link Identity) error {
+	if s == nil {
+		return nil
+	}
+	link.Email = strings.ToLower(link.Email)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT `+identityColumns+` FROM identities
+		WHERE feishu_open_id = ? OR feishu_union_id = ? OR feishu_user_id = ?
+			OR zitadel_user_id = ? OR newapi_user_id = ? OR openwebui_user_id = ?
+		ORDER BY id`,
+		nullString(link.FeishuOpenId), nullString(link.FeishuUnionId), nullString(link.FeishuUserId),
+		nullString(link.ZitadelUserId), nullInt(link.NewApiUserId), nullString(link.OpenWebUiUserId),
+	)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	merged := &Identity{}
+	for rows.Next() {
+		id, i, err := scanIdentity(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		merged.merge(i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	merged.merge(&link)
+	merged.UpdatedAt = time.Now().Unix()
+
+	if len(ids) > 1 {
+		for _, id := range ids[1:] {
+			if _, err := tx.Exec(`DELETE FROM identities WHERE id = ?`, id); err != nil {
+				return err
+			}
+		}
+		log.Info().Int("rows", len(ids)).Any("identity", merged).Msg("merged identities")
+	}
+
+	args := []any{
+		nullString(merged.FeishuOpenId), nullString(merged.FeishuUnionId), nullString(merged.FeishuUserId),
+		nullString(merged.ZitadelUserId), nullInt(merged.NewApiUserId), nullString(merged.OpenWebUiUserId),
+		nullString(merged.Email), merged.UpdatedAt,
+	}
+
+	if len(ids) == 0 {
+		_, err = tx.Exec(
+			`INSERT INTO identities(feishu_open_id, feishu_union_id, feishu_user_id, zitadel_user_id, newapi_user_id, openwebui_user_id, email, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			args...,
+		)
+	} else {
+		_, err = tx.Exec(
+			`UPDATE identities SET feishu_open_id = ?, feishu_union_id = ?, feishu_user_id = ?, zitadel_user_id = ?,
+				newapi_user_id = ?, openwebui_user_id = ?, email = ?, updated_at = ?
+			WHERE id = ?`,
+			append(args, ids[0])...,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LookupIdentity finds the identity that any of its IDs or its email equals anyId.
+func (s *Store) LookupIdentity(anyId string) (*Identity, error) {
+	if s == nil {
+		return nil, ErrIdentityNotFound
+	}
+
+	newApiId, err := strconv.Atoi(anyId)
+	if err != nil {
+		newApiId = 0
+	}
+
+	row := s.db.QueryRow(
+		`SELECT `+identityColumns+` FROM identities
+		WHERE feishu_open_id = ?1 OR feishu_union_id = ?1 OR feishu_user_id = ?1
+			OR zitadel_user_id = ?1 OR openwebui_user_id = ?1 OR newapi_user_id = ?2 OR email = ?3
+		LIMIT 1`,
+		anyId, nullInt(newApiId), strings.ToLower(anyId),
+	)
+
+	_, i, err := scanIdentity(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdentityNotFound
+	}
+	return i, err
+}
+
+// linkIdentity is the fire-and-forget variant used by actors, a failing
+// store must never break the actual sync.
+func (s *Store) linkIdentity(link Identity) {
+	if err := s.LinkIdentity(link); err != nil {
+		log.Warn().Err(err).Any("identity", link).Msg("failed to record identity link")
+	}
+}
@@ -0,0 +1,250 @@
+package out
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type InboxEvent struct {
+	Id        int64           `json:"id"`
+	EventId   string          `json:"event_id"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+	FailedAt  int64           `json:"failed_at,omitempty"`
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// EnqueueInboxEvent persists an event for processing. Events that are already
+// queued, processed or dead-lettered are ignored, reporting false.
+func (s *Store) EnqueueInboxEvent(eventId, eventType string, payload []byte) (bool, error) {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(
+		`INSERT OR IGNORE INTO feishu_inbox(event_id, event_type, payload, next_attempt_at, created_at)
+		SELECT ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM feishu_processed_events WHERE event_id = ?)
+			AND NOT EXISTS (SELECT 1 FROM feishu_dead_letters WHERE event_id = ?)`,
+		eventId, eventType, payload, now, now, eventId, eventId,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ClaimInboxEvents returns up to limit due events and hides them from the next
+// claim for lease, so events of a crashed worker come back on their own.
+func (s *Store) ClaimInboxEvents(limit int, lease time.Duration) ([]*InboxEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query(
+		`SELECT id, event_id, event_type, payload, attempts, last_error, created_at
+		FROM feishu_inbox WHERE next_attempt_at <= ? ORDER BY id LIMIT ?`,
+		now.Unix(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*InboxEvent{}
+	for rows.Next() {
+		var e InboxEvent
+		var lastError sql.NullString
+		if err := rows.Scan(&e.Id, &e.EventId, &e.EventType, &e.Payload, &e.Attempts, &lastError, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.LastError = lastError.String
+		events = append(events, &e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		_, err := tx.Exec(`UPDATE feishu_inbox SET next_attempt_at = ? WHERE id = ?`, now.Add(lease).Unix(), e.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, tx.Commit()
+}
+
+// CompleteInboxEvent removes a processed (or discarded) event from the inbox,
+// remembers its ID for de-duplication and advances the user's version to the
+// event's create_time.
+func (s *Store) CompleteInboxEvent(e *InboxEvent, openId string, createTime int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM feishu_inbox WHERE id = ?`, e.Id); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO feishu_processed_events(event_id, processed_at) VALUES (?, ?)`,
+		e.EventId, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if openId != "" {
+		_, err = tx.Exec(
+			`INSERT INTO feishu_user_versions(open_id, create_time) VALUES (?, ?)
+			ON CONFLICT(open_id) DO UPDATE SET create_time = MAX(create_time, excluded.create_time)`,
+			openId, createTime,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FeishuUserVersion returns the create_time of the newest event processed for
+// the user, or 0.
+func (s *Store) FeishuUserVersion(openId string) (int64, error) {
+	var createTime int64
+	err := s.db.QueryRow(`SELECT create_time FROM feishu_user_versions WHERE open_id = ?`, openId).Scan(&createTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return createTime, err
+}
+
+// PruneProcessedFeishuEvents forgets processed event IDs older than the
+// redelivery window.
+func (s *Store) PruneProcessedFeishuEvents(olderThan time.Duration) error {
+	_, err := s.db.Exec(`DELETE FROM feishu_processed_events WHERE processed_at < ?`, time.Now().Add(-olderThan).Unix())
+	return err
+}
+
+// RetryInboxEvent records a failed attempt and schedules the next one.
+func (s *Store) RetryInboxEvent(id int64, cause error, nextAttempt time.Time) error {
+	_, err := s.db.Exec(
+		`UPDATE feishu_inbox SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+		cause.Error(), nextAttempt.Unix(), id,
+	)
+	return err
+}
+
+// DeadLetterInboxEvent moves an event that failed for good out of the inbox.
+func (s *Store) DeadLetterInboxEvent(id int64, cause error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO feishu_dead_letters(event_id, event_type, payload, attempts, last_error, created_at, failed_at)
+		SELECT event_id, event_type, payload, attempts + 1, ?, created_at, ? FROM feishu_inbox WHERE id = ?`,
+		cause.Error(), time.Now().Unix(), id,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM feishu_inbox WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) ListDeadLetters() ([]*InboxEvent, error) {
+	rows, err := s.db.Query(
+		`SELECT id, event_id, event_type, payload, attempts, last_error, created_at, failed_at
+		FROM feishu_dead_letters ORDER BY id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*InboxEvent{}
+	for rows.Next() {
+		e, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Store) GetDeadLetter(id int64) (*InboxEvent, error) {
+	row := s.db.QueryRow(
+		`SELECT id, event_id, event_type, payload, attempts, last_error, created_at, failed_at
+		FROM feishu_dead_letters WHERE id = ?`,
+		id,
+	)
+
+	e, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeadLetterNotFound
+	}
+	return e, err
+}
+
+// ReplayDeadLetter puts a dead-lettered event back into the inbox with a
+// fresh retry budget.
+func (s *Store) ReplayDeadLetter(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(
+		`INSERT OR IGNORE INTO feishu_inbox(event_id, event_type, payload, next_attempt_at, created_at)
+		SELECT event_id, event_type, payload, ?, created_at FROM feishu_dead_letters WHERE id = ?`,
+		now, id,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDeadLetterNotFound
+	}
+
+	if _, err := tx.Exec(`DELETE FROM feishu_dead_letters WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func scanDeadLetter(row rowScanner) (*InboxEvent, error) {
+	var e InboxEvent
+	var lastError sql.NullString
+	err := row.Scan(&e.Id, &e.EventId, &e.EventType, &e.Payload, &e.Attempts, &lastError, &e.CreatedAt, &e.FailedAt)
+	if err != nil {
+		return nil, err
+	}
+	e.LastError = lastError.String
+	return &e, nil
+}
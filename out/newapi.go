@@ -1,26 +1,40 @@
 package out
 
 import (
-	"database/sql"
-	"math/rand"
+	"crypto/rand"
+	"math/big"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lakelink/auth-companion/misc"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
 const keyChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+// RandStringBytes draws API keys and passwords, so from crypto/rand.
 func RandStringBytes(n int) string {
+	max := big.NewInt(int64(len(keyChars)))
 	b := make([]byte, n)
 	for i := range b {
-		b[i] = keyChars[rand.Intn(len(keyChars))]
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = keyChars[c.Int64()]
 	}
 	return string(b)
 }
 
 type NewApiActor struct {
-	db *sql.DB
+	backend newApiBackend
+	store   *Store
+
+	policies map[string]misc.NewApiTokenPolicyConfig
+
+	provision      bool
+	provisionGroup string
+	provisionQuota int64
 }
 
 type NewApiEnsureTokenResponse struct {
@@ -28,56 +42,65 @@ type NewApiEnsureTokenResponse struct {
 	Token   string `json:"token"`
 }
 
-func NewNewApiActor(dbPath string) *NewApiActor {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		panic(err)
+// NewNewApiActor reaches New API following newapi.mode, see newApiBackend.
+func NewNewApiActor(mode string, store *Store) *NewApiActor {
+	h := &NewApiActor{
+		backend:  newNewApiBackend(mode),
+		store:    store,
+		policies: loadTokenPolicies(),
+
+		provision:      viper.GetBool("newapi.provision.enabled"),
+		provisionGroup: viper.GetString("newapi.provision.group"),
+		provisionQuota: viper.GetInt64("newapi.provision.quota"),
 	}
 
-	h := &NewApiActor{
-		db: db,
+	if err := h.ApplyTokenPolicies(); err != nil {
+		log.Error().Err(err).Msg("token policies are not fully applied")
 	}
 
+	log.Info().Str("mode", mode).Msg("New API backend configured")
+
 	return h
 }
 
-func (h *NewApiActor) EnsureToken(oidcUserId, tokenName, tokenGroup string) (*NewApiEnsureTokenResponse, error) {
-	row := h.db.QueryRow("SELECT id, username, oidc_id FROM users WHERE oidc_id = ? AND deleted_at IS NULL", oidcUserId)
+// findUser resolves the New API user of an OIDC subject, handing the backend
+// what the identity store remembers before it searches.
+func (h *NewApiActor) findUser(oidcUserId string) (user_id int, username string, err error) {
+	var known *Identity
+	if i, err := h.store.LookupIdentity(oidcUserId); err == nil && i.ZitadelUserId == oidcUserId {
+		known = i
+	}
 
-	var user_id int
-	var username, oidc_id string
-	if err := row.Scan(&user_id, &username, &oidc_id); err != nil {
-		return nil, err
+	user_id, username, err = h.backend.findUser(oidcUserId, known)
+	if err != nil {
+		return 0, "", err
 	}
 
-	log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", oidc_id).Msg("user found")
+	if known == nil || known.NewApiUserId != user_id {
+		h.store.linkIdentity(Identity{ZitadelUserId: oidcUserId, NewApiUserId: user_id})
+	}
 
-	now := time.Now().Unix()
+	return user_id, username, nil
+}
 
-	// group is a SQL keyword
-	res, err := h.db.Exec(
-		`INSERT INTO tokens(user_id, key, name, created_time, accessed_time, unlimited_quota, [group])
-		SELECT ?, ?, ?, ?, ?, 1, ?
-		WHERE NOT EXISTS (SELECT id FROM tokens WHERE user_id = ? AND name = ? AND deleted_at IS NULL)`,
-		user_id, RandStringBytes(48), tokenName, now, now, tokenGroup, user_id, tokenName,
-	)
+func (h *NewApiActor) EnsureToken(oidcUserId, tokenName, tokenGroup string) (*NewApiEnsureTokenResponse, error) {
+	user_id, username, err := h.findUser(oidcUserId)
 	if err != nil {
 		return nil, err
 	}
 
-	if n, err := res.RowsAffected(); err != nil {
+	log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", oidcUserId).Msg("user found")
+
+	settings := h.tokenSettings(tokenGroup, time.Now().Unix(), 0)
+	token_id, token, created, err := h.backend.ensureToken(user_id, tokenName, tokenGroup, settings)
+	if err != nil {
 		return nil, err
-	} else if n == 1 {
-		log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", oidc_id).Msg("token created")
-	} else {
-		log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", oidc_id).Msg("token already exists")
 	}
 
-	var token_id int
-	var token string
-	row = h.db.QueryRow("SELECT id, key FROM tokens WHERE user_id = ? AND name = ? AND deleted_at IS NULL", user_id, tokenName)
-	if err := row.Scan(&token_id, &token); err != nil {
-		return nil, err
+	if created {
+		log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", oidcUserId).Msg("token created")
+	} else {
+		log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", oidcUserId).Msg("token already exists")
 	}
 
 	token = "sk-" + token
@@ -0,0 +1,67 @@
+package out
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	NewApiModeDB  = "db"
+	NewApiModeApi = "api"
+)
+
+var (
+	ErrNewApiUserNotFound = errors.New("New API user not found")
+	ErrNewApiUnsupported  = errors.New("not supported by this newapi.mode")
+)
+
+// newApiBackend is how NewApiActor reaches New API, selected by newapi.mode:
+// its database or its admin HTTP API. The actor keeps the identity store and
+// the policies, backends only read and write New API.
+type newApiBackend interface {
+	// findUser returns ErrNewApiUserNotFound when no live user has the
+	// oidc_id, known is what the identity store remembers of the user.
+	findUser(oidcUserId string, known *Identity) (userId int, username string, err error)
+	// setUserStatus reports whether the user had status from and was changed.
+	setUserStatus(userId, from, to int) (changed bool, err error)
+	// createUser returns the existing user when the oidc_id already has one,
+	// the username is the first of usernames that is free.
+	createUser(p *NewApiProfile, usernames []string, group string, quota int64) (userId int, username string, err error)
+	balance(userId int) (*NewApiBalance, error)
+	// usage aggregates the consume logs created in [from, to) per user,
+	// model and day, days are taken in loc.
+	usage(from, to time.Time, loc *time.Location) ([]*NewApiUsage, error)
+
+	// ensureToken returns the key of the live token named tokenName, creating
+	// it with the settings when there is none.
+	ensureToken(userId int, tokenName, tokenGroup string, settings newApiTokenSettings) (tokenId int, key string, created bool, err error)
+	listTokens(userId int) ([]*NewApiToken, error)
+	rotateToken(userId, tokenId int) (newTokenId int, key string, err error)
+	// revokeToken soft-deletes the token, of any user when userId is nil.
+	revokeToken(tokenId int, userId *int) error
+	setTokenStatus(userId, tokenId, from, to int) error
+	// applyTokenSettings rewrites the policy controlled columns of every
+	// live token of the group, returning how many there were.
+	applyTokenSettings(tokenGroup string, settings func(createdTime, usedQuota int64) newApiTokenSettings) (int, error)
+}
+
+func newNewApiBackend(mode string) newApiBackend {
+	switch mode {
+	case NewApiModeDB:
+		db, err := openNewApiDB(viper.GetString("newapi.sql_dsn"), viper.GetString("newapi.db_path"))
+		if err != nil {
+			panic(err)
+		}
+		return &newApiDBBackend{db}
+	case NewApiModeApi:
+		return newNewApiHttpBackend(
+			viper.GetString("newapi.api.base_url"),
+			viper.GetString("newapi.api.access_token"),
+			viper.GetInt("newapi.api.user_id"),
+		)
+	default:
+		panic("unknown newapi.mode " + mode)
+	}
+}
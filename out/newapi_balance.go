@@ -0,0 +1,34 @@
+package out
+
+// NewApiBalance is the credit of a New API user, quotas are in New API's
+// quota units (QuotaPerUnit per dollar).
+type NewApiBalance struct {
+	UserId       int    `json:"user_id"`
+	Username     string `json:"username"`
+	Group        string `json:"group"`
+	Quota        int64  `json:"quota"`
+	UsedQuota    int64  `json:"used_quota"`
+	RequestCount int64  `json:"request_count"`
+
+	// nil when the backend cannot read tokens
+	Tokens []*NewApiTokenBalance `json:"tokens"`
+}
+
+type NewApiTokenBalance struct {
+	Id             int    `json:"id"`
+	Name           string `json:"name"`
+	Status         int    `json:"status"`
+	RemainQuota    int64  `json:"remain_quota"`
+	UsedQuota      int64  `json:"used_quota"`
+	UnlimitedQuota bool   `json:"unlimited_quota"`
+	ExpiredTime    int64  `json:"expired_time"`
+}
+
+// Balance returns the remaining quota of the OIDC user and its live tokens.
+func (h *NewApiActor) Balance(oidcUserId string) (*NewApiBalance, error) {
+	user_id, _, err := h.findUser(oidcUserId)
+	if err != nil {
+		return nil, err
+	}
+	return h.backend.balance(user_id)
+}
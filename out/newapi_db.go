@@ -0,0 +1,369 @@
+package out
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// newApiDBBackend writes New API's tables directly, see openNewApiDB for the
+// databases it supports.
+type newApiDBBackend struct {
+	db *newApiDB
+}
+
+func (b *newApiDBBackend) findUser(oidcUserId string, known *Identity) (user_id int, username string, err error) {
+	if known != nil && known.NewApiUserId != 0 {
+		row := b.db.QueryRow("SELECT id, username FROM users WHERE id = ? AND oidc_id = ? AND deleted_at IS NULL", known.NewApiUserId, oidcUserId)
+		if err := row.Scan(&user_id, &username); err == nil {
+			return user_id, username, nil
+		}
+	}
+
+	row := b.db.QueryRow("SELECT id, username FROM users WHERE oidc_id = ? AND deleted_at IS NULL", oidcUserId)
+	err = row.Scan(&user_id, &username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", ErrNewApiUserNotFound
+	}
+	return user_id, username, err
+}
+
+func (b *newApiDBBackend) setUserStatus(userId, from, to int) (bool, error) {
+	result, err := b.db.Exec("UPDATE users SET status = ? WHERE id = ? AND status = ?", to, userId, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (b *newApiDBBackend) createUser(p *NewApiProfile, usernames []string, group string, quota int64) (int, string, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var user_id int
+	var username string
+	err = tx.QueryRow("SELECT id, username FROM users WHERE oidc_id = ? AND deleted_at IS NULL", p.OidcId).Scan(&user_id, &username)
+	if err == nil {
+		return user_id, username, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, "", err
+	}
+
+	username = ""
+	for _, candidate := range usernames {
+		// soft-deleted users keep their username
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", candidate).Scan(&n); err != nil {
+			return 0, "", err
+		}
+		if n == 0 {
+			username = candidate
+			break
+		}
+	}
+	if username == "" {
+		return 0, "", errors.New("no free username among " + strings.Join(usernames, ", "))
+	}
+
+	// the password is no bcrypt hash, so password login never matches it
+	id, err := tx.InsertId(
+		`INSERT INTO users(username, password, display_name, role, status, email, oidc_id, [group], quota, aff_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		username, RandStringBytes(32), p.DisplayName, newApiUserRoleCommon, newApiUserStatusEnabled, p.Email, p.OidcId, group, quota, RandStringBytes(16),
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	return int(id), username, nil
+}
+
+func (b *newApiDBBackend) balance(userId int) (*NewApiBalance, error) {
+	balance := &NewApiBalance{UserId: userId}
+	err := b.db.QueryRow(
+		"SELECT username, COALESCE([group], ''), quota, used_quota, request_count FROM users WHERE id = ? AND deleted_at IS NULL",
+		userId,
+	).Scan(&balance.Username, &balance.Group, &balance.Quota, &balance.UsedQuota, &balance.RequestCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNewApiUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := b.db.Query(
+		`SELECT id, name, status, remain_quota, used_quota, unlimited_quota, expired_time
+		FROM tokens WHERE user_id = ? AND deleted_at IS NULL ORDER BY id`,
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balance.Tokens = []*NewApiTokenBalance{}
+	for rows.Next() {
+		var t NewApiTokenBalance
+		if err := rows.Scan(&t.Id, &t.Name, &t.Status, &t.RemainQuota, &t.UsedQuota, &t.UnlimitedQuota, &t.ExpiredTime); err != nil {
+			return nil, err
+		}
+		balance.Tokens = append(balance.Tokens, &t)
+	}
+	return balance, rows.Err()
+}
+
+// usage groups the consume logs in the query, the day of a log is the
+// index of the first day ending after it.
+func (b *newApiDBBackend) usage(from, to time.Time, loc *time.Location) ([]*NewApiUsage, error) {
+	days, ends := newApiUsageDays(from, to, loc)
+	if len(days) == 0 {
+		return []*NewApiUsage{}, nil
+	}
+
+	var bucket strings.Builder
+	args := []any{}
+	bucket.WriteString("CASE")
+	for i, end := range ends {
+		bucket.WriteString(" WHEN created_at < ? THEN " + strconv.Itoa(i))
+		args = append(args, end)
+	}
+	bucket.WriteString(" END")
+	args = append(args, newApiLogTypeConsume, from.Unix(), to.Unix())
+
+	rows, err := b.db.Query(
+		`SELECT user_id, MAX(username), model_name, `+bucket.String()+` AS day_index,
+			COUNT(*), SUM(quota), SUM(prompt_tokens), SUM(completion_tokens)
+		FROM logs WHERE type = ? AND created_at >= ? AND created_at < ?
+		GROUP BY user_id, model_name, day_index`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []*NewApiUsage{}
+	for rows.Next() {
+		var u NewApiUsage
+		var day int
+		if err := rows.Scan(&u.UserId, &u.Username, &u.ModelName, &day, &u.Requests, &u.Quota, &u.PromptTokens, &u.CompletionTokens); err != nil {
+			return nil, err
+		}
+		u.Day = days[day]
+		usage = append(usage, &u)
+	}
+	return usage, rows.Err()
+}
+
+// newApiLockRetries bounds the retries of a transaction that lost a lock.
+const newApiLockRetries = 5
+
+// ensureToken looks for the token and creates it in one transaction holding
+// the user's lock, so concurrent calls end up with a single token.
+func (b *newApiDBBackend) ensureToken(userId int, tokenName, tokenGroup string, settings newApiTokenSettings) (token_id int, token string, created bool, err error) {
+	for attempt := 1; ; attempt++ {
+		token_id, token, created, err = b.ensureTokenTx(userId, tokenName, tokenGroup, settings)
+		if !isNewApiLocked(err) || attempt == newApiLockRetries {
+			return token_id, token, created, err
+		}
+		log.Warn().Err(err).Int("user_id", userId).Int("attempt", attempt).Msg("New API database locked, retrying")
+		time.Sleep(time.Duration(attempt*attempt) * 50 * time.Millisecond)
+	}
+}
+
+func (b *newApiDBBackend) ensureTokenTx(userId int, tokenName, tokenGroup string, settings newApiTokenSettings) (int, string, bool, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.LockUser(userId); err != nil {
+		return 0, "", false, err
+	}
+
+	var token_id int
+	var token string
+	created := false
+	row := tx.QueryRow("SELECT id, [key] FROM tokens WHERE user_id = ? AND name = ? AND deleted_at IS NULL", userId, tokenName)
+	err = row.Scan(&token_id, &token)
+	if errors.Is(err, sql.ErrNoRows) {
+		now := time.Now().Unix()
+		token = RandStringBytes(48)
+
+		// group and key are SQL keywords
+		id, err := tx.InsertId(
+			`INSERT INTO tokens(user_id, [key], name, created_time, accessed_time, remain_quota, unlimited_quota, expired_time, model_limits_enabled, model_limits, allow_ips, [group])
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			userId, token, tokenName, now, now,
+			settings.RemainQuota, settings.UnlimitedQuota, settings.ExpiredTime, settings.ModelLimitsEnabled, settings.ModelLimits, settings.AllowIps,
+			tokenGroup,
+		)
+		if err != nil {
+			return 0, "", false, err
+		}
+		token_id = int(id)
+		created = true
+	} else if err != nil {
+		return 0, "", false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", false, err
+	}
+
+	return token_id, token, created, nil
+}
+
+func (b *newApiDBBackend) listTokens(userId int) ([]*NewApiToken, error) {
+	rows, err := b.db.Query(
+		`SELECT id, user_id, name, COALESCE([group], ''), status, [key], created_time, accessed_time, expired_time, remain_quota, unlimited_quota
+		FROM tokens WHERE user_id = ? AND deleted_at IS NULL ORDER BY id`,
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*NewApiToken{}
+	for rows.Next() {
+		var t NewApiToken
+		var key string
+		err := rows.Scan(&t.Id, &t.UserId, &t.Name, &t.Group, &t.Status, &key, &t.CreatedTime, &t.AccessedTime, &t.ExpiredTime, &t.RemainQuota, &t.UnlimitedQuota)
+		if err != nil {
+			return nil, err
+		}
+		t.KeyHint = keyHint(key)
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+func (b *newApiDBBackend) rotateToken(userId, tokenId int) (int, string, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	if err := tx.LockUser(userId); err != nil {
+		return 0, "", err
+	}
+
+	var status int
+	var name string
+	var expiredTime, remainQuota, usedQuota int64
+	var unlimitedQuota bool
+	var modelLimitsEnabled sql.NullBool
+	var modelLimits, allowIps, group sql.NullString
+	err = tx.QueryRow(
+		`SELECT status, name, expired_time, remain_quota, unlimited_quota, used_quota, model_limits_enabled, model_limits, allow_ips, [group]
+		FROM tokens WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		tokenId, userId,
+	).Scan(&status, &name, &expiredTime, &remainQuota, &unlimitedQuota, &usedQuota, &modelLimitsEnabled, &modelLimits, &allowIps, &group)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", ErrNewApiTokenNotFound
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE tokens SET deleted_at = ? WHERE id = ?", now, tokenId); err != nil {
+		return 0, "", err
+	}
+
+	key := RandStringBytes(48)
+	newTokenId, err := tx.InsertId(
+		`INSERT INTO tokens(user_id, [key], status, name, created_time, accessed_time, expired_time, remain_quota, unlimited_quota, used_quota, model_limits_enabled, model_limits, allow_ips, [group])
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userId, key, status, name, now.Unix(), now.Unix(), expiredTime, remainQuota, unlimitedQuota, usedQuota,
+		modelLimitsEnabled.Bool, modelLimits.String, allowIps.String, group.String,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+
+	return int(newTokenId), key, nil
+}
+
+func (b *newApiDBBackend) revokeToken(tokenId int, userId *int) error {
+	query := "UPDATE tokens SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	args := []any{time.Now(), tokenId}
+	if userId != nil {
+		query += " AND user_id = ?"
+		args = append(args, *userId)
+	}
+
+	res, err := b.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNewApiTokenNotFound
+	}
+	return nil
+}
+
+func (b *newApiDBBackend) setTokenStatus(userId, tokenId, from, to int) error {
+	_, err := b.db.Exec("UPDATE tokens SET status = ? WHERE id = ? AND user_id = ? AND status = ?", to, tokenId, userId, from)
+	return err
+}
+
+func (b *newApiDBBackend) applyTokenSettings(tokenGroup string, settings func(createdTime, usedQuota int64) newApiTokenSettings) (int, error) {
+	rows, err := b.db.Query("SELECT id, created_time, used_quota FROM tokens WHERE [group] = ? AND deleted_at IS NULL", tokenGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	type token struct {
+		id          int
+		createdTime int64
+		usedQuota   int64
+	}
+	tokens := []token{}
+	for rows.Next() {
+		var t token
+		if err := rows.Scan(&t.id, &t.createdTime, &t.usedQuota); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, t := range tokens {
+		s := settings(t.createdTime, t.usedQuota)
+		_, err := b.db.Exec(
+			`UPDATE tokens SET remain_quota = ?, unlimited_quota = ?, expired_time = ?, model_limits_enabled = ?, model_limits = ?, allow_ips = ?
+			WHERE id = ?`,
+			s.RemainQuota, s.UnlimitedQuota, s.ExpiredTime, s.ModelLimitsEnabled, s.ModelLimits, s.AllowIps, t.id,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(tokens), nil
+}
@@ -0,0 +1,335 @@
+package out
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newApiTestDB is a New API database to run the DB backend against. SQLite is
+// always tested, MySQL and PostgreSQL when NEWAPI_TEST_MYSQL_DSN or
+// NEWAPI_TEST_POSTGRES_DSN name a scratch database, whose users, tokens and
+// logs tables get dropped.
+type newApiTestDB struct {
+	name string
+	dsn  string
+}
+
+func newApiTestDBs(t *testing.T) []newApiTestDB {
+	dbs := []newApiTestDB{{"sqlite3", ""}}
+	for _, d := range []struct{ name, env string }{
+		{"mysql", "NEWAPI_TEST_MYSQL_DSN"},
+		{"postgres", "NEWAPI_TEST_POSTGRES_DSN"},
+	} {
+		if dsn := os.Getenv(d.env); dsn != "" {
+			dbs = append(dbs, newApiTestDB{d.name, dsn})
+		} else {
+			t.Logf("%s not set, skipping %s", d.env, d.name)
+		}
+	}
+	return dbs
+}
+
+// newApiTestSchema is the part of New API's schema the companion touches,
+// written like the queries for newApiDialect.rewrite.
+func newApiTestSchema(driver string) []string {
+	id, datetime := "INTEGER PRIMARY KEY AUTOINCREMENT", "DATETIME"
+	switch driver {
+	case "mysql":
+		id, datetime = "BIGINT AUTO_INCREMENT PRIMARY KEY", "DATETIME(3)"
+	case "postgres":
+		id, datetime = "BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"
+	}
+
+	return []string{
+		"DROP TABLE IF EXISTS logs",
+		"DROP TABLE IF EXISTS tokens",
+		"DROP TABLE IF EXISTS users",
+		`CREATE TABLE users (
+			id            ` + id + `,
+			username      VARCHAR(191) NOT NULL UNIQUE,
+			password      VARCHAR(191) NOT NULL,
+			display_name  VARCHAR(191),
+			role          BIGINT NOT NULL DEFAULT 1,
+			status        BIGINT NOT NULL DEFAULT 1,
+			email         VARCHAR(191),
+			oidc_id       VARCHAR(191),
+			[group]       VARCHAR(64) DEFAULT 'default',
+			quota         BIGINT NOT NULL DEFAULT 0,
+			used_quota    BIGINT NOT NULL DEFAULT 0,
+			request_count BIGINT NOT NULL DEFAULT 0,
+			aff_code      VARCHAR(32),
+			deleted_at    ` + datetime + `
+		)`,
+		`CREATE TABLE tokens (
+			id                   ` + id + `,
+			user_id              BIGINT NOT NULL,
+			[key]                CHAR(48) NOT NULL UNIQUE,
+			status               BIGINT NOT NULL DEFAULT 1,
+			name                 VARCHAR(191),
+			created_time         BIGINT,
+			accessed_time        BIGINT,
+			expired_time         BIGINT DEFAULT -1,
+			remain_quota         BIGINT DEFAULT 0,
+			unlimited_quota      BOOLEAN DEFAULT FALSE,
+			used_quota           BIGINT DEFAULT 0,
+			model_limits_enabled BOOLEAN DEFAULT FALSE,
+			model_limits         VARCHAR(1024) DEFAULT '',
+			allow_ips            VARCHAR(1024) DEFAULT '',
+			[group]              VARCHAR(64) DEFAULT '',
+			deleted_at           ` + datetime + `
+		)`,
+		`CREATE TABLE logs (
+			id                ` + id + `,
+			user_id           BIGINT,
+			created_at        BIGINT,
+			type              BIGINT,
+			username          VARCHAR(191) DEFAULT '',
+			model_name        VARCHAR(191) DEFAULT '',
+			quota             BIGINT DEFAULT 0,
+			prompt_tokens     BIGINT DEFAULT 0,
+			completion_tokens BIGINT DEFAULT 0
+		)`,
+	}
+}
+
+// openNewApiTestDB opens an empty New API database with one user, whose id
+// it returns.
+func openNewApiTestDB(t *testing.T, d newApiTestDB) (*newApiDBBackend, int) {
+	t.Helper()
+
+	db, err := openNewApiDB(d.dsn, filepath.Join(t.TempDir(), "one-api.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, stmt := range newApiTestSchema(db.dialect.driver) {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", strings.Fields(stmt)[0], err)
+		}
+	}
+
+	b := &newApiDBBackend{db}
+	userId, _, err := b.createUser(&NewApiProfile{Username: "alice", DisplayName: "Alice", Email: "alice@example.com", OidcId: "oidc-alice"}, []string{"alice"}, "default", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, userId
+}
+
+func TestNewApiDBEnsureToken(t *testing.T) {
+	for _, d := range newApiTestDBs(t) {
+		t.Run(d.name, func(t *testing.T) {
+			b, userId := openNewApiTestDB(t, d)
+			settings := newApiTokenSettings{RemainQuota: 100, ExpiredTime: -1, ModelLimits: "gpt-4o", ModelLimitsEnabled: true}
+
+			id, key, created, err := b.ensureToken(userId, "open-webui", "open-webui", settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !created || id == 0 || len(key) != 48 {
+				t.Fatalf("got id %d, key %q, created %v, want a new token", id, key, created)
+			}
+
+			again, againKey, created, err := b.ensureToken(userId, "open-webui", "open-webui", settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created || again != id || againKey != key {
+				t.Errorf("second call got id %d created %v, want the existing token %d", again, created, id)
+			}
+
+			tokens, err := b.listTokens(userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 1 || tokens[0].Group != "open-webui" || tokens[0].RemainQuota != 100 {
+				t.Errorf("got tokens %+v, want the one token", tokens)
+			}
+		})
+	}
+}
+
+// TestNewApiDBEnsureTokenConcurrent has many requests of one user race for
+// the token, they must all get the single token created.
+func TestNewApiDBEnsureTokenConcurrent(t *testing.T) {
+	const callers = 100
+
+	for _, d := range newApiTestDBs(t) {
+		t.Run(d.name, func(t *testing.T) {
+			b, userId := openNewApiTestDB(t, d)
+
+			var wg sync.WaitGroup
+			keys := make([]string, callers)
+			errs := make([]error, callers)
+			for i := range callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, keys[i], _, errs[i] = b.ensureToken(userId, "open-webui", "open-webui", newApiTokenSettings{ExpiredTime: -1})
+				}()
+			}
+			wg.Wait()
+
+			for i := range callers {
+				if errs[i] != nil {
+					t.Fatalf("caller %d: %v", i, errs[i])
+				}
+				if keys[i] != keys[0] {
+					t.Fatalf("caller %d got key %q, caller 0 %q", i, keys[i], keys[0])
+				}
+			}
+
+			var n int
+			if err := b.db.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id = ?", userId).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("created %d tokens, want 1", n)
+			}
+		})
+	}
+}
+
+// TestNewApiDBJournalMode checks the companion leaves SQLite's journal mode
+// to New API.
+func TestNewApiDBJournalMode(t *testing.T) {
+	b, _ := openNewApiTestDB(t, newApiTestDB{"sqlite3", ""})
+
+	var mode string
+	if err := b.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "delete" {
+		t.Errorf("got journal mode %q, want SQLite's default delete", mode)
+	}
+}
+
+func TestNewApiDBRotateToken(t *testing.T) {
+	for _, d := range newApiTestDBs(t) {
+		t.Run(d.name, func(t *testing.T) {
+			b, userId := openNewApiTestDB(t, d)
+
+			id, key, _, err := b.ensureToken(userId, "open-webui", "open-webui", newApiTokenSettings{RemainQuota: 100, ExpiredTime: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newId, newKey, err := b.rotateToken(userId, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if newId == id || newKey == key || len(newKey) != 48 {
+				t.Fatalf("got id %d key %q, want a new token replacing %d", newId, newKey, id)
+			}
+
+			tokens, err := b.listTokens(userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tokens) != 1 || tokens[0].Id != newId || tokens[0].Name != "open-webui" || tokens[0].Group != "open-webui" || tokens[0].RemainQuota != 100 {
+				t.Errorf("got tokens %+v, want only the rotated token with the old settings", tokens)
+			}
+
+			if _, _, err := b.rotateToken(userId, id); err != ErrNewApiTokenNotFound {
+				t.Errorf("rotating the replaced token: got %v, want ErrNewApiTokenNotFound", err)
+			}
+			if _, _, err := b.rotateToken(userId+1, newId); err != ErrNewApiTokenNotFound {
+				t.Errorf("rotating another user's token: got %v, want ErrNewApiTokenNotFound", err)
+			}
+		})
+	}
+}
+
+// TestNewApiTxInsertId covers RETURNING id on PostgreSQL and LastInsertId
+// elsewhere.
+func TestNewApiTxInsertId(t *testing.T) {
+	for _, d := range newApiTestDBs(t) {
+		t.Run(d.name, func(t *testing.T) {
+			b, userId := openNewApiTestDB(t, d)
+
+			tx, err := b.db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			ids := []int64{}
+			for _, key := range []string{strings.Repeat("a", 48), strings.Repeat("b", 48)} {
+				id, err := tx.InsertId("INSERT INTO tokens(user_id, [key], name, [group]) VALUES (?, ?, ?, ?)", userId, key, "t", "g")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+			if ids[0] == 0 || ids[1] <= ids[0] {
+				t.Fatalf("got ids %v, want increasing ids", ids)
+			}
+
+			var key string
+			if err := tx.QueryRow("SELECT [key] FROM tokens WHERE id = ?", ids[1]).Scan(&key); err != nil {
+				t.Fatal(err)
+			}
+			if key != strings.Repeat("b", 48) {
+				t.Errorf("id %d has key %q, want the second token", ids[1], key)
+			}
+		})
+	}
+}
+
+// TestNewApiDBUsage checks the query splits days at the midnights of the
+// location and leaves out other log types and times.
+func TestNewApiDBUsage(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, loc)
+	to := from.AddDate(0, 0, 2)
+
+	for _, d := range newApiTestDBs(t) {
+		t.Run(d.name, func(t *testing.T) {
+			b, userId := openNewApiTestDB(t, d)
+
+			for _, l := range []struct {
+				at    time.Time
+				typ   int
+				model string
+			}{
+				{from.Add(-time.Second), newApiLogTypeConsume, "gpt-4o"},
+				{from, newApiLogTypeConsume, "gpt-4o"},
+				{from.Add(23 * time.Hour), newApiLogTypeConsume, "gpt-4o"},
+				{from.Add(23 * time.Hour), newApiLogTypeConsume, "o3"},
+				{from.Add(23 * time.Hour), 1, "gpt-4o"},
+				{from.Add(24 * time.Hour), newApiLogTypeConsume, "gpt-4o"},
+				{to, newApiLogTypeConsume, "gpt-4o"},
+			} {
+				_, err := b.db.Exec("INSERT INTO logs(user_id, created_at, type, username, model_name, quota, prompt_tokens, completion_tokens) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+					userId, l.at.Unix(), l.typ, "alice", l.model, 10, 1, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			usage, err := (&NewApiActor{backend: b}).Usage(from, to, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []NewApiUsage{
+				{userId, "alice", "gpt-4o", "2026-03-01", 2, 20, 2, 4},
+				{userId, "alice", "o3", "2026-03-01", 1, 10, 1, 2},
+				{userId, "alice", "gpt-4o", "2026-03-02", 1, 10, 1, 2},
+			}
+			if len(usage) != len(want) {
+				t.Fatalf("got %d rows, want %d", len(usage), len(want))
+			}
+			for i := range want {
+				if *usage[i] != want[i] {
+					t.Errorf("row %d: got %+v, want %+v", i, *usage[i], want[i])
+				}
+			}
+		})
+	}
+}
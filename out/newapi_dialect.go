@@ -0,0 +1,167 @@
+package out
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// newApiDialect rewrites the queries of NewApiActor, which are written for
+// SQLite, for the database New API runs on: [ident] quotes an identifier,
+// group and key are keywords, and PostgreSQL numbers its placeholders.
+type newApiDialect struct {
+	driver string
+}
+
+var newApiIdentPattern = regexp.MustCompile(`\[(\w+)\]`)
+
+func (d newApiDialect) rewrite(query string) string {
+	switch d.driver {
+	case "mysql":
+		query = newApiIdentPattern.ReplaceAllString(query, "`$1`")
+	case "postgres":
+		query = newApiIdentPattern.ReplaceAllString(query, `"$1"`)
+
+		var b strings.Builder
+		n := 0
+		for _, r := range query {
+			if r == '?' {
+				n++
+				b.WriteString("$" + strconv.Itoa(n))
+			} else {
+				b.WriteRune(r)
+			}
+		}
+		query = b.String()
+	default:
+		query = newApiIdentPattern.ReplaceAllString(query, `"$1"`)
+	}
+	return query
+}
+
+// openNewApiDB follows New API's own SQL_DSN: empty for SQLite at sqlitePath,
+// postgres:// for PostgreSQL, anything else is a MySQL DSN.
+func openNewApiDB(dsn, sqlitePath string) (*newApiDB, error) {
+	d := newApiDialect{"sqlite3"}
+	switch {
+	case dsn == "" || dsn == "local":
+		dsn = sqliteDSN(sqlitePath)
+	case strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://"):
+		d.driver = "postgres"
+	default:
+		d.driver = "mysql"
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &newApiDB{db, d}, nil
+}
+
+// sqliteDSN shares the database with New API: transactions take the write
+// lock when they begin rather than failing to upgrade a read lock, and
+// writers wait for each other. The journal mode is New API's to choose, it
+// persists in the database file.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_busy_timeout=5000&_txlock=immediate"
+}
+
+// isNewApiLocked reports whether err is lock contention worth retrying.
+func isNewApiLocked(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// deadlock, lock wait timeout
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization failure, deadlock
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
+
+// newApiDB and newApiTx rewrite every query through the dialect.
+type newApiDB struct {
+	*sql.DB
+	dialect newApiDialect
+}
+
+func (db *newApiDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rewrite(query), args...)
+}
+
+func (db *newApiDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rewrite(query), args...)
+}
+
+func (db *newApiDB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rewrite(query), args...)
+}
+
+func (db *newApiDB) Begin() (*newApiTx, error) {
+	tx, err := db.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &newApiTx{tx, db.dialect}, nil
+}
+
+type newApiTx struct {
+	*sql.Tx
+	dialect newApiDialect
+}
+
+func (tx *newApiTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rewrite(query), args...)
+}
+
+func (tx *newApiTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rewrite(query), args...)
+}
+
+func (tx *newApiTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rewrite(query), args...)
+}
+
+// LockUser serializes the transactions writing tokens of the user. SQLite
+// transactions hold the database write lock already.
+func (tx *newApiTx) LockUser(userId int) error {
+	if tx.dialect.driver == "sqlite3" {
+		return nil
+	}
+	var id int
+	return tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userId).Scan(&id)
+}
+
+// InsertId runs an INSERT and returns the new row's id, PostgreSQL has no
+// LastInsertId.
+func (tx *newApiTx) InsertId(query string, args ...any) (int64, error) {
+	if tx.dialect.driver == "postgres" {
+		var id int64
+		err := tx.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,54 @@
+package out
+
+import "testing"
+
+func TestNewApiDialectRewrite(t *testing.T) {
+	tests := []struct {
+		driver string
+		query  string
+		want   string
+	}{
+		{
+			"sqlite3",
+			"SELECT id, [key] FROM tokens WHERE user_id = ? AND [group] = ?",
+			`SELECT id, "key" FROM tokens WHERE user_id = ? AND "group" = ?`,
+		},
+		{
+			"mysql",
+			"SELECT id, [key] FROM tokens WHERE user_id = ? AND [group] = ?",
+			"SELECT id, `key` FROM tokens WHERE user_id = ? AND `group` = ?",
+		},
+		{
+			"postgres",
+			"SELECT id, [key] FROM tokens WHERE user_id = ? AND [group] = ?",
+			`SELECT id, "key" FROM tokens WHERE user_id = $1 AND "group" = $2`,
+		},
+		{
+			"postgres",
+			"INSERT INTO tokens(user_id, [key], name, created_time, accessed_time, remain_quota, unlimited_quota, expired_time, model_limits_enabled, model_limits, allow_ips, [group]) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			`INSERT INTO tokens(user_id, "key", name, created_time, accessed_time, remain_quota, unlimited_quota, expired_time, model_limits_enabled, model_limits, allow_ips, "group") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		},
+		{
+			"postgres",
+			"UPDATE users SET status = ? WHERE id = ?",
+			"UPDATE users SET status = $1 WHERE id = $2",
+		},
+		{
+			// only word characters are identifiers
+			"mysql",
+			"SELECT [a-b] FROM t",
+			"SELECT [a-b] FROM t",
+		},
+		{
+			"sqlite3",
+			"SELECT COUNT(*) FROM users",
+			"SELECT COUNT(*) FROM users",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := (newApiDialect{tt.driver}).rewrite(tt.query); got != tt.want {
+			t.Errorf("%s: rewrite(%q)\n got %q\nwant %q", tt.driver, tt.query, got, tt.want)
+		}
+	}
+}
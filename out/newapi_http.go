@@ -0,0 +1,295 @@
+package out
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newApiHttpBackend talks to New API's management API with the access token
+// of an admin, the New-Api-User header must name that admin.
+//
+// New API scopes /api/token to the user the access token belongs to, so
+// tokens of other users cannot be managed this way and the token operations
+// return ErrNewApiUnsupported, the companion does not act as its users.
+// Users are found and enabled or disabled through /api/user.
+type newApiHttpBackend struct {
+	baseUrl     string
+	accessToken string
+	userId      int
+	client      *http.Client
+}
+
+func newNewApiHttpBackend(baseUrl, accessToken string, userId int) *newApiHttpBackend {
+	if baseUrl == "" || accessToken == "" || userId == 0 {
+		panic("newapi.api.base_url, newapi.api.access_token and newapi.api.user_id are required by newapi.mode api")
+	}
+	return &newApiHttpBackend{
+		baseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		accessToken: accessToken,
+		userId:      userId,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// newApiHttpResponse is the envelope of every New API response, failures are
+// mostly reported with success false rather than the status code.
+type newApiHttpResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type newApiHttpUser struct {
+	Id           int    `json:"id"`
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	OidcId       string `json:"oidc_id"`
+	Status       int    `json:"status"`
+	Group        string `json:"group"`
+	Quota        int64  `json:"quota"`
+	UsedQuota    int64  `json:"used_quota"`
+	RequestCount int64  `json:"request_count"`
+}
+
+func (b *newApiHttpBackend) call(method, path string, body any, data any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, b.baseUrl+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.accessToken)
+	req.Header.Set("New-Api-User", strconv.Itoa(b.userId))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("New API %s %s: %s", method, path, resp.Status)
+	}
+
+	var r newApiHttpResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if !r.Success {
+		return fmt.Errorf("New API %s %s: %s", method, path, r.Message)
+	}
+
+	if data != nil && len(r.Data) > 0 {
+		return json.Unmarshal(r.Data, data)
+	}
+	return nil
+}
+
+// decodeNewApiItems accepts both the plain list of older New API releases and
+// the paginated result of newer ones.
+func decodeNewApiItems(data json.RawMessage, items any) error {
+	if err := json.Unmarshal(data, items); err == nil {
+		return nil
+	}
+
+	var page struct {
+		Items json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(data, &page); err != nil {
+		return err
+	}
+	if len(page.Items) == 0 {
+		return nil
+	}
+	return json.Unmarshal(page.Items, items)
+}
+
+func (b *newApiHttpBackend) searchUsers(keyword string) ([]newApiHttpUser, error) {
+	var data json.RawMessage
+	if err := b.call(http.MethodGet, "/api/user/search?keyword="+url.QueryEscape(keyword), nil, &data); err != nil {
+		return nil, err
+	}
+
+	var users []newApiHttpUser
+	return users, decodeNewApiItems(data, &users)
+}
+
+// newApiHttpPageSize is the page size of every listing.
+const newApiHttpPageSize = 100
+
+// scanUsers pages through every user for the oidc_id.
+func (b *newApiHttpBackend) scanUsers(oidcUserId string) (*newApiHttpUser, error) {
+	for page := 1; ; page++ {
+		var data json.RawMessage
+		query := url.Values{"p": {strconv.Itoa(page)}, "page_size": {strconv.Itoa(newApiHttpPageSize)}}
+		if err := b.call(http.MethodGet, "/api/user/?"+query.Encode(), nil, &data); err != nil {
+			return nil, err
+		}
+
+		var users []newApiHttpUser
+		if err := decodeNewApiItems(data, &users); err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			if u.OidcId == oidcUserId {
+				return &u, nil
+			}
+		}
+		if len(users) < newApiHttpPageSize {
+			return nil, ErrNewApiUserNotFound
+		}
+	}
+}
+
+// findUser tries the ID and email the identity store knows before it pages
+// through every user, New API does not search oidc_id.
+func (b *newApiHttpBackend) findUser(oidcUserId string, known *Identity) (int, string, error) {
+	if known != nil && known.NewApiUserId != 0 {
+		var u newApiHttpUser
+		err := b.call(http.MethodGet, "/api/user/"+strconv.Itoa(known.NewApiUserId), nil, &u)
+		if err == nil && u.OidcId == oidcUserId {
+			return u.Id, u.Username, nil
+		}
+	}
+
+	if known != nil && known.Email != "" {
+		users, err := b.searchUsers(known.Email)
+		if err != nil {
+			return 0, "", err
+		}
+		for _, u := range users {
+			if u.OidcId == oidcUserId {
+				return u.Id, u.Username, nil
+			}
+		}
+	}
+
+	u, err := b.scanUsers(oidcUserId)
+	if err != nil {
+		return 0, "", err
+	}
+	return u.Id, u.Username, nil
+}
+
+func (b *newApiHttpBackend) setUserStatus(userId, from, to int) (bool, error) {
+	var u newApiHttpUser
+	if err := b.call(http.MethodGet, "/api/user/"+strconv.Itoa(userId), nil, &u); err != nil {
+		return false, err
+	}
+	if u.Status != from {
+		return false, nil
+	}
+
+	action := "enable"
+	if to == newApiUserStatusDisabled {
+		action = "disable"
+	}
+	err := b.call(http.MethodPost, "/api/user/manage", map[string]any{"id": userId, "action": action}, nil)
+	return err == nil, err
+}
+
+// createUser is unsupported, the admin API cannot set oidc_id.
+func (b *newApiHttpBackend) createUser(p *NewApiProfile, usernames []string, group string, quota int64) (int, string, error) {
+	return 0, "", ErrNewApiUnsupported
+}
+
+// balance has no tokens, New API lists them only to their owner and the
+// admin API has no per-token quota, see listTokens.
+func (b *newApiHttpBackend) balance(userId int) (*NewApiBalance, error) {
+	var u newApiHttpUser
+	if err := b.call(http.MethodGet, "/api/user/"+strconv.Itoa(userId), nil, &u); err != nil {
+		return nil, err
+	}
+	return &NewApiBalance{
+		UserId:       u.Id,
+		Username:     u.Username,
+		Group:        u.Group,
+		Quota:        u.Quota,
+		UsedQuota:    u.UsedQuota,
+		RequestCount: u.RequestCount,
+		Tokens:       []*NewApiTokenBalance{},
+	}, nil
+}
+
+// usage pages through the admin log API, which has no aggregation.
+func (b *newApiHttpBackend) usage(from, to time.Time, loc *time.Location) ([]*NewApiUsage, error) {
+	entries, err := b.consumeLogs(from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return aggregateNewApiUsage(entries, loc), nil
+}
+
+func (b *newApiHttpBackend) consumeLogs(from, to int64) ([]newApiLogEntry, error) {
+	entries := []newApiLogEntry{}
+	for page := 1; ; page++ {
+		var data struct {
+			Total int `json:"total"`
+			Items []struct {
+				UserId           int    `json:"user_id"`
+				Username         string `json:"username"`
+				ModelName        string `json:"model_name"`
+				CreatedAt        int64  `json:"created_at"`
+				Quota            int64  `json:"quota"`
+				PromptTokens     int64  `json:"prompt_tokens"`
+				CompletionTokens int64  `json:"completion_tokens"`
+			} `json:"items"`
+		}
+		// end_timestamp is inclusive
+		query := url.Values{
+			"p":               {strconv.Itoa(page)},
+			"page_size":       {strconv.Itoa(newApiHttpPageSize)},
+			"type":            {strconv.Itoa(newApiLogTypeConsume)},
+			"start_timestamp": {strconv.FormatInt(from, 10)},
+			"end_timestamp":   {strconv.FormatInt(to-1, 10)},
+		}
+		if err := b.call(http.MethodGet, "/api/log/?"+query.Encode(), nil, &data); err != nil {
+			return nil, err
+		}
+
+		for _, i := range data.Items {
+			entries = append(entries, newApiLogEntry(i))
+		}
+		if len(data.Items) < newApiHttpPageSize || len(entries) >= data.Total {
+			return entries, nil
+		}
+	}
+}
+
+func (b *newApiHttpBackend) ensureToken(userId int, tokenName, tokenGroup string, settings newApiTokenSettings) (int, string, bool, error) {
+	return 0, "", false, ErrNewApiUnsupported
+}
+
+func (b *newApiHttpBackend) listTokens(userId int) ([]*NewApiToken, error) {
+	return nil, ErrNewApiUnsupported
+}
+
+func (b *newApiHttpBackend) rotateToken(userId, tokenId int) (int, string, error) {
+	return 0, "", ErrNewApiUnsupported
+}
+
+func (b *newApiHttpBackend) revokeToken(tokenId int, userId *int) error {
+	return ErrNewApiUnsupported
+}
+
+func (b *newApiHttpBackend) setTokenStatus(userId, tokenId, from, to int) error {
+	return ErrNewApiUnsupported
+}
+
+func (b *newApiHttpBackend) applyTokenSettings(tokenGroup string, settings func(createdTime, usedQuota int64) newApiTokenSettings) (int, error) {
+	return 0, ErrNewApiUnsupported
+}
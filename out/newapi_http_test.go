@@ -0,0 +1,146 @@
+package out
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeNewApi is the part of New API's admin API the HTTP backend uses, user
+// 1 is the admin.
+type fakeNewApi struct {
+	mu    sync.Mutex
+	users []map[string]any
+}
+
+const fakeNewApiAdminToken = "admin-access-token"
+
+func newFakeNewApi(t *testing.T, users int) (*fakeNewApi, *httptest.Server) {
+	f := &fakeNewApi{}
+	for id := 1; id <= users; id++ {
+		f.users = append(f.users, map[string]any{
+			"id":       id,
+			"username": "user" + strconv.Itoa(id),
+			"email":    "user" + strconv.Itoa(id) + "@example.com",
+			"oidc_id":  "oidc-" + strconv.Itoa(id),
+			"status":   newApiUserStatusEnabled,
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/user/", f.admin(f.listUsers))
+	mux.HandleFunc("GET /api/user/search", f.admin(f.searchUsers))
+	mux.HandleFunc("GET /api/user/{id}", f.admin(f.getUser))
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func fakeNewApiReply(w http.ResponseWriter, data any) {
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "message": "", "data": data})
+}
+
+func fakeNewApiFail(w http.ResponseWriter, message string) {
+	json.NewEncoder(w).Encode(map[string]any{"success": false, "message": message})
+}
+
+func (f *fakeNewApi) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeNewApiAdminToken || r.Header.Get("New-Api-User") != "1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fakeNewApiFail(w, "not an admin")
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		h(w, r)
+	}
+}
+
+func (f *fakeNewApi) listUsers(w http.ResponseWriter, r *http.Request) {
+	p, _ := strconv.Atoi(r.URL.Query().Get("p"))
+	size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	items := []map[string]any{}
+	for i := (p - 1) * size; i < len(f.users) && i < p*size; i++ {
+		items = append(items, f.users[i])
+	}
+	fakeNewApiReply(w, map[string]any{"items": items, "total": len(f.users), "page": p, "page_size": size})
+}
+
+func (f *fakeNewApi) searchUsers(w http.ResponseWriter, r *http.Request) {
+	items := []map[string]any{}
+	for _, u := range f.users {
+		if u["email"] == r.URL.Query().Get("keyword") {
+			items = append(items, u)
+		}
+	}
+	fakeNewApiReply(w, items)
+}
+
+func (f *fakeNewApi) getUser(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	if id < 1 || id > len(f.users) {
+		fakeNewApiFail(w, "record not found")
+		return
+	}
+	fakeNewApiReply(w, f.users[id-1])
+}
+
+func newTestNewApiHttpBackend(t *testing.T, users int) (*fakeNewApi, *newApiHttpBackend) {
+	f, srv := newFakeNewApi(t, users)
+	return f, newNewApiHttpBackend(srv.URL, fakeNewApiAdminToken, 1)
+}
+
+func TestNewApiHttpFindUser(t *testing.T) {
+	_, b := newTestNewApiHttpBackend(t, 250)
+
+	tests := []struct {
+		name  string
+		known *Identity
+		want  int
+	}{
+		{"by id", &Identity{NewApiUserId: 42}, 42},
+		{"by email", &Identity{Email: "user42@example.com"}, 42},
+		{"stale id", &Identity{NewApiUserId: 7}, 42},
+		{"unknown", nil, 42},
+		{"last page", nil, 250},
+	}
+	for _, tt := range tests {
+		id, username, err := b.findUser("oidc-"+strconv.Itoa(tt.want), tt.known)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if id != tt.want || username != "user"+strconv.Itoa(tt.want) {
+			t.Errorf("%s: got user %d %q, want %d", tt.name, id, username, tt.want)
+		}
+	}
+
+	if _, _, err := b.findUser("oidc-nobody", nil); err != ErrNewApiUserNotFound {
+		t.Errorf("missing user: got %v, want ErrNewApiUserNotFound", err)
+	}
+}
+
+// TestNewApiHttpTokensUnsupported checks the token operations, which need
+// the user's own access token, are refused rather than impersonating.
+func TestNewApiHttpTokensUnsupported(t *testing.T) {
+	_, b := newTestNewApiHttpBackend(t, 1)
+
+	if _, _, _, err := b.ensureToken(1, "open-webui", "open-webui", newApiTokenSettings{}); err != ErrNewApiUnsupported {
+		t.Errorf("ensureToken: got %v", err)
+	}
+	if _, err := b.listTokens(1); err != ErrNewApiUnsupported {
+		t.Errorf("listTokens: got %v", err)
+	}
+	if _, _, err := b.rotateToken(1, 1); err != ErrNewApiUnsupported {
+		t.Errorf("rotateToken: got %v", err)
+	}
+	if err := b.revokeToken(1, nil); err != ErrNewApiUnsupported {
+		t.Errorf("revokeToken: got %v", err)
+	}
+	if err := b.setTokenStatus(1, 1, newApiTokenStatusEnabled, newApiTokenStatusDisabled); err != ErrNewApiUnsupported {
+		t.Errorf("setTokenStatus: got %v", err)
+	}
+}
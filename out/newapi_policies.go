@@ -0,0 +1,107 @@
+package out
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lakelink/auth-companion/misc"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// newApiTokenSettings are the policy controlled columns of a token.
+type newApiTokenSettings struct {
+	RemainQuota        int64
+	UnlimitedQuota     bool
+	ExpiredTime        int64 // -1 never expires
+	ModelLimitsEnabled bool
+	ModelLimits        string
+	AllowIps           string
+}
+
+func loadTokenPolicies() map[string]misc.NewApiTokenPolicyConfig {
+	var policies []misc.NewApiTokenPolicyConfig
+	if err := viper.UnmarshalKey("newapi.token_policies", &policies); err != nil {
+		log.Error().Err(err).Msg("invalid newapi.token_policies")
+	}
+
+	m := map[string]misc.NewApiTokenPolicyConfig{}
+	for _, p := range policies {
+		m[p.Group] = p
+	}
+	return m
+}
+
+// tokenSettings applies the policy of the token group to a token created at
+// createdTime. Groups without a policy keep the original unlimited tokens.
+func (h *NewApiActor) tokenSettings(tokenGroup string, createdTime int64, usedQuota int64) newApiTokenSettings {
+	p, ok := h.policies[tokenGroup]
+	if !ok {
+		return newApiTokenSettings{UnlimitedQuota: true, ExpiredTime: -1}
+	}
+
+	s := newApiTokenSettings{
+		UnlimitedQuota:     p.Quota == 0,
+		RemainQuota:        max(p.Quota-usedQuota, 0),
+		ExpiredTime:        -1,
+		ModelLimitsEnabled: len(p.Models) > 0,
+		ModelLimits:        strings.Join(p.Models, ","),
+		AllowIps:           strings.Join(p.Subnets, "\n"),
+	}
+	if p.Expiry > 0 {
+		s.ExpiredTime = createdTime + int64(p.Expiry/time.Second)
+	}
+	return s
+}
+
+func tokenPolicyFingerprint(p misc.NewApiTokenPolicyConfig) string {
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// ApplyTokenPolicies re-applies every policy that changed since it was last
+// applied to the existing tokens of its group.
+func (h *NewApiActor) ApplyTokenPolicies() error {
+	for group, p := range h.policies {
+		fingerprint := tokenPolicyFingerprint(p)
+		applied, err := h.store.TokenPolicyFingerprint(group)
+		if err != nil {
+			return err
+		}
+		if applied == fingerprint {
+			continue
+		}
+
+		err = h.applyTokenPolicy(group)
+		if errors.Is(err, ErrNewApiUnsupported) {
+			log.Warn().Msg("this newapi.mode cannot apply newapi.token_policies to existing tokens")
+			return nil
+		} else if err != nil {
+			log.Error().Err(err).Str("group", group).Msg("failed to apply token policy")
+			return err
+		}
+
+		if err := h.store.SetTokenPolicyFingerprint(group, fingerprint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *NewApiActor) applyTokenPolicy(tokenGroup string) error {
+	n, err := h.backend.applyTokenSettings(tokenGroup, func(createdTime, usedQuota int64) newApiTokenSettings {
+		return h.tokenSettings(tokenGroup, createdTime, usedQuota)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("group", tokenGroup).Int("tokens", n).Msg("token policy applied")
+	return nil
+}
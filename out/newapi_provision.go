@@ -0,0 +1,80 @@
+package out
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+	user "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/user/v2"
+)
+
+// New API validates usernames to at most 20 characters
+const newApiUsernameMaxLength = 20
+
+var ErrNewApiProvisionInactive = errors.New("only active human ZITADEL users are provisioned")
+
+// NewApiProfile is what a provisioned New API user starts with.
+type NewApiProfile struct {
+	Username    string
+	DisplayName string
+	Email       string
+	OidcId      string
+}
+
+func NewApiProfileFromZitadel(u *user.User) (*NewApiProfile, error) {
+	human := u.GetHuman()
+	if human == nil || u.GetState() != user.UserState_USER_STATE_ACTIVE {
+		return nil, ErrNewApiProvisionInactive
+	}
+
+	return &NewApiProfile{
+		Username:    u.GetUsername(),
+		DisplayName: human.GetProfile().GetDisplayName(),
+		Email:       human.GetEmail().GetEmail(),
+		OidcId:      u.GetUserId(),
+	}, nil
+}
+
+// newApiUsernames are the usernames tried for a provisioned user in order:
+// the ZITADEL username without its domain, then one derived from the OIDC
+// subject, which is unique.
+func newApiUsernames(p *NewApiProfile) []string {
+	local, _, _ := strings.Cut(p.Username, "@")
+	local = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return -1
+	}, local)
+
+	oidc := "oidc_" + p.OidcId
+	if len(oidc) > newApiUsernameMaxLength {
+		oidc = "oidc_" + p.OidcId[len(p.OidcId)-(newApiUsernameMaxLength-len("oidc_")):]
+	}
+
+	names := []string{}
+	if runes := []rune(local); len(runes) > 0 {
+		names = append(names, string(runes[:min(len(runes), newApiUsernameMaxLength)]))
+	}
+	return append(names, oidc)
+}
+
+func (h *NewApiActor) ProvisionEnabled() bool {
+	return h.provision
+}
+
+// ProvisionUser creates the New API user of the profile the way its OIDC
+// login would, in newapi.provision.group with newapi.provision.quota.
+func (h *NewApiActor) ProvisionUser(p *NewApiProfile) (int, error) {
+	user_id, username, err := h.backend.createUser(p, newApiUsernames(p), h.provisionGroup, h.provisionQuota)
+	if err != nil {
+		log.Error().Err(err).Str("oidc_id", p.OidcId).Msg("failed to provision New API user")
+		return 0, err
+	}
+
+	h.store.linkIdentity(Identity{ZitadelUserId: p.OidcId, NewApiUserId: user_id, Email: p.Email})
+
+	log.Info().Int("user_id", user_id).Str("username", username).Str("oidc_id", p.OidcId).Str("group", h.provisionGroup).Msg("New API user provisioned")
+	return user_id, nil
+}
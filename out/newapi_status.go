@@ -0,0 +1,136 @@
+package out
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+// status and role values of New API's users and tokens tables
+const (
+	newApiUserRoleCommon      = 1
+	newApiUserStatusEnabled   = 1
+	newApiUserStatusDisabled  = 2
+	newApiTokenStatusEnabled  = 1
+	newApiTokenStatusDisabled = 2
+)
+
+// findUserForOffboarding is findUser where a missing New API user is not an
+// error, the person may never have used it.
+func (h *NewApiActor) findUserForOffboarding(oidcUserId string) (int, bool, error) {
+	user_id, _, err := h.findUser(oidcUserId)
+	if errors.Is(err, ErrNewApiUserNotFound) {
+		log.Info().Str("oidc_id", oidcUserId).Msg("no New API user, nothing to do")
+		return 0, false, nil
+	}
+	return user_id, err == nil, err
+}
+
+// DisableUser disables the enabled user and remembers it for EnableUser.
+func (h *NewApiActor) DisableUser(oidcUserId string) error {
+	user_id, found, err := h.findUserForOffboarding(oidcUserId)
+	if !found {
+		return err
+	}
+
+	changed, err := h.backend.setUserStatus(user_id, newApiUserStatusEnabled, newApiUserStatusDisabled)
+	if err != nil || !changed {
+		return err
+	}
+	if err := h.store.RememberDisabledNewApiUser(user_id); err != nil {
+		return err
+	}
+
+	log.Info().Int("user_id", user_id).Str("oidc_id", oidcUserId).Msg("New API user disabled")
+	return nil
+}
+
+// EnableUser enables the user if DisableUser disabled it, not one disabled
+// by hand.
+func (h *NewApiActor) EnableUser(oidcUserId string) error {
+	user_id, found, err := h.findUserForOffboarding(oidcUserId)
+	if !found {
+		return err
+	}
+
+	disabled, err := h.store.NewApiUserDisabled(user_id)
+	if err != nil || !disabled {
+		return err
+	}
+
+	if _, err := h.backend.setUserStatus(user_id, newApiUserStatusDisabled, newApiUserStatusEnabled); err != nil {
+		return err
+	}
+	if err := h.store.ForgetDisabledNewApiUser(user_id); err != nil {
+		return err
+	}
+
+	log.Info().Int("user_id", user_id).Str("oidc_id", oidcUserId).Msg("New API user enabled")
+	return nil
+}
+
+// DisableTokens disables every enabled token of the user and remembers them
+// for RestoreTokens.
+func (h *NewApiActor) DisableTokens(oidcUserId string) error {
+	user_id, found, err := h.findUserForOffboarding(oidcUserId)
+	if !found {
+		return err
+	}
+
+	tokens, err := h.backend.listTokens(user_id)
+	if errors.Is(err, ErrNewApiUnsupported) {
+		// New API rejects the tokens of a disabled user anyway
+		log.Warn().Int("user_id", user_id).Str("oidc_id", oidcUserId).Msg("tokens left enabled, this newapi.mode cannot disable them")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	tokenIds := []int{}
+	for _, t := range tokens {
+		if t.Status == newApiTokenStatusEnabled {
+			tokenIds = append(tokenIds, t.Id)
+		}
+	}
+
+	// remember first, restoring a token that was never disabled is harmless
+	if err := h.store.RememberDisabledNewApiTokens(user_id, tokenIds); err != nil {
+		return err
+	}
+
+	for _, id := range tokenIds {
+		if err := h.backend.setTokenStatus(user_id, id, newApiTokenStatusEnabled, newApiTokenStatusDisabled); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Int("user_id", user_id).Str("oidc_id", oidcUserId).Ints("tokens", tokenIds).Msg("New API tokens disabled")
+	return nil
+}
+
+// RestoreTokens enables the tokens DisableTokens disabled.
+func (h *NewApiActor) RestoreTokens(oidcUserId string) error {
+	user_id, found, err := h.findUserForOffboarding(oidcUserId)
+	if !found {
+		return err
+	}
+
+	tokenIds, err := h.store.DisabledNewApiTokens(user_id)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range tokenIds {
+		if err := h.backend.setTokenStatus(user_id, id, newApiTokenStatusDisabled, newApiTokenStatusEnabled); err != nil {
+			return err
+		}
+	}
+
+	if err := h.store.ForgetDisabledNewApiTokens(user_id); err != nil {
+		return err
+	}
+
+	if len(tokenIds) > 0 {
+		log.Info().Int("user_id", user_id).Str("oidc_id", oidcUserId).Ints("tokens", tokenIds).Msg("New API tokens restored")
+	}
+	return nil
+}
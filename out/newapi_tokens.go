@@ -0,0 +1,89 @@
+package out
+
+import (
+	"errors"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNewApiTokenNotFound = errors.New("token not found")
+
+// NewApiToken describes a token without its key, which is only ever returned
+// by EnsureToken and RotateToken.
+type NewApiToken struct {
+	Id             int    `json:"id"`
+	UserId         int    `json:"user_id"`
+	Name           string `json:"name"`
+	Group          string `json:"group"`
+	Status         int    `json:"status"`
+	KeyHint        string `json:"key_hint"`
+	CreatedTime    int64  `json:"created_time"`
+	AccessedTime   int64  `json:"accessed_time"`
+	ExpiredTime    int64  `json:"expired_time"`
+	RemainQuota    int64  `json:"remain_quota"`
+	UnlimitedQuota bool   `json:"unlimited_quota"`
+}
+
+// keyHint keeps just enough of a key to tell tokens apart.
+func keyHint(key string) string {
+	if len(key) < 8 {
+		return "sk-..."
+	}
+	return "sk-" + key[:4] + "..." + key[len(key)-4:]
+}
+
+// ListTokens returns the live tokens of the OIDC user.
+func (h *NewApiActor) ListTokens(oidcUserId string) ([]*NewApiToken, error) {
+	user_id, _, err := h.findUser(oidcUserId)
+	if err != nil {
+		return nil, err
+	}
+	return h.backend.listTokens(user_id)
+}
+
+// RotateToken replaces the token with a copy under a new key and soft-deletes
+// the old one. The new key is returned only here.
+func (h *NewApiActor) RotateToken(oidcUserId string, tokenId int) (*NewApiEnsureTokenResponse, error) {
+	user_id, username, err := h.findUser(oidcUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	newTokenId, key, err := h.backend.rotateToken(user_id, tokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Int("user_id", user_id).Str("username", username).Int("old_token_id", tokenId).Int("token_id", newTokenId).Msg("token rotated")
+
+	return &NewApiEnsureTokenResponse{newTokenId, "sk-" + key}, nil
+}
+
+// RevokeToken soft-deletes a token of the OIDC user.
+func (h *NewApiActor) RevokeToken(oidcUserId string, tokenId int) error {
+	user_id, _, err := h.findUser(oidcUserId)
+	if err != nil {
+		return err
+	}
+	return h.revokeToken(tokenId, &user_id)
+}
+
+// RevokeTokenById soft-deletes any token, for admins.
+func (h *NewApiActor) RevokeTokenById(tokenId int) error {
+	return h.revokeToken(tokenId, nil)
+}
+
+func (h *NewApiActor) revokeToken(tokenId int, userId *int) error {
+	if err := h.backend.revokeToken(tokenId, userId); err != nil {
+		return err
+	}
+
+	log.Info().Int("token_id", tokenId).Msg("token revoked")
+	return nil
+}
+
+// IsNewApiNotFound reports whether err means the user or token does not
+// exist, as opposed to a database failure.
+func IsNewApiNotFound(err error) bool {
+	return errors.Is(err, ErrNewApiUserNotFound) || errors.Is(err, ErrNewApiTokenNotFound)
+}
@@ -0,0 +1,97 @@
+package out
+
+import (
+	"sort"
+	"time"
+)
+
+// New API's logs.type of a consumed request
+const newApiLogTypeConsume = 2
+
+// newApiLogEntry is a consume log row of New API.
+type newApiLogEntry struct {
+	UserId           int
+	Username         string
+	ModelName        string
+	CreatedAt        int64
+	Quota            int64
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+// NewApiUsage is the usage of a user with a model on a day.
+type NewApiUsage struct {
+	UserId           int    `json:"user_id"`
+	Username         string `json:"username"`
+	ModelName        string `json:"model_name"`
+	Day              string `json:"day"` // 2006-01-02
+	Requests         int64  `json:"requests"`
+	Quota            int64  `json:"quota"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+}
+
+// newApiUsageDays splits [from, to) at the midnights of loc, days[i] starts
+// at ends[i-1] or from and ends before ends[i].
+func newApiUsageDays(from, to time.Time, loc *time.Location) (days []string, ends []int64) {
+	for start := from.In(loc); start.Before(to); {
+		end := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, loc)
+		if end.After(to) {
+			end = to
+		}
+		days = append(days, start.Format(time.DateOnly))
+		ends = append(ends, end.Unix())
+		start = end
+	}
+	return days, ends
+}
+
+// aggregateNewApiUsage is the per user, model and day aggregation for
+// backends that cannot do it in a query.
+func aggregateNewApiUsage(entries []newApiLogEntry, loc *time.Location) []*NewApiUsage {
+	type key struct {
+		userId int
+		model  string
+		day    string
+	}
+	usage := map[key]*NewApiUsage{}
+	for _, e := range entries {
+		k := key{e.UserId, e.ModelName, time.Unix(e.CreatedAt, 0).In(loc).Format(time.DateOnly)}
+		u, ok := usage[k]
+		if !ok {
+			u = &NewApiUsage{UserId: e.UserId, Username: e.Username, ModelName: e.ModelName, Day: k.day}
+			usage[k] = u
+		}
+		u.Requests++
+		u.Quota += e.Quota
+		u.PromptTokens += e.PromptTokens
+		u.CompletionTokens += e.CompletionTokens
+	}
+
+	result := make([]*NewApiUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, u)
+	}
+	return result
+}
+
+// Usage aggregates the consume logs in [from, to) per user, model and day,
+// days are taken in loc.
+func (h *NewApiActor) Usage(from, to time.Time, loc *time.Location) ([]*NewApiUsage, error) {
+	result, err := h.backend.usage(from, to, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.UserId != b.UserId {
+			return a.UserId < b.UserId
+		}
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return a.ModelName < b.ModelName
+	})
+	return result, nil
+}
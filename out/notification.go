@@ -0,0 +1,119 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lakelink/auth-companion/misc"
+)
+
+const (
+	NotificationFormatText = "text"
+	NotificationFormatCard = "card"
+)
+
+// Notification is what a NotificationSink delivers, each sink renders it as
+// well as its destination allows.
+type Notification struct {
+	Type      string              `json:"type"`
+	Title     string              `json:"title"`
+	Content   string              `json:"content"`
+	Fields    []NotificationField `json:"fields,omitempty"`
+	Timestamp int64               `json:"timestamp"`
+
+	// Color is a Feishu card template name, see NewFeishuCard
+	Color    string `json:"color"`
+	Source   string `json:"source"`
+	RemoteIp string `json:"remote_ip"`
+
+	// Location is the zone the timestamp is shown in, UTC when nil
+	Location *time.Location `json:"-"`
+}
+
+type NotificationField struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// NotificationSink delivers notifications to one destination.
+type NotificationSink interface {
+	Notify(n *Notification) error
+}
+
+var ErrNotificationDst = errors.New("incorrect dst")
+
+// NewNotificationSink builds the sink of a destination, Actor selects the
+// kind and Dst is its address:
+//   - feishu: "receive_id_type:receive_id" messaged by the app
+//   - feishu_bot: a custom group bot webhook URL, DstSecret signs
+//   - http: a URL receiving the notification as JSON, DstSecret signs
+//   - slack: a Slack-compatible incoming webhook URL
+//   - smtp: comma separated email addresses, sent through smtp.*
+func NewNotificationSink(c misc.NotificationDstConfig, feishuActor *FeishuActor) (NotificationSink, error) {
+	switch c.Actor {
+	case "feishu":
+		return newFeishuAppSink(feishuActor, c.Dst, c.Format)
+	case "feishu_bot":
+		return newFeishuBotSink(c.Dst, c.DstSecret, c.Format)
+	case "http":
+		return newHttpSink(c.Dst, c.DstSecret)
+	case "slack":
+		return newSlackSink(c.Dst)
+	case "smtp":
+		return newSmtpSink(c.Dst)
+	default:
+		return nil, errors.New("unknown actor " + c.Actor)
+	}
+}
+
+// Text is the plain text rendering, a mail-like header and the content.
+func (n *Notification) Text() string {
+	return fmt.Sprintf(
+		"Received: from %s\nFrom: %s\nSubject: %s\n\n%s",
+		n.RemoteIp, n.Source, n.Title, n.Content,
+	)
+}
+
+func (n *Notification) title() string {
+	if n.Title == "" {
+		return n.Type
+	}
+	return n.Title
+}
+
+// note says where the notification came from.
+func (n *Notification) note() string {
+	note := fmt.Sprintf("%s from %s (%s)", n.Type, n.Source, n.RemoteIp)
+	if n.Timestamp > 0 {
+		loc := n.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+		note += " at " + time.Unix(n.Timestamp, 0).In(loc).Format("2006-01-02 15:04:05 MST")
+	}
+	return note
+}
+
+// Card renders the title in a header of Color, the content, the fields and
+// a note of the source.
+func (n *Notification) Card() *FeishuCard {
+	color := n.Color
+	if color == "" {
+		color = "blue"
+	}
+
+	card := NewFeishuCard(n.title(), color)
+	if n.Content != "" {
+		card.AddMarkdown(n.Content)
+	}
+
+	fields := []FeishuCardField{}
+	for _, f := range n.Fields {
+		fields = append(fields, FeishuCardField{f.Key, f.Value})
+	}
+	card.AddFields(fields)
+	card.AddDivider()
+
+	return card.AddNote(n.note())
+}
@@ -0,0 +1,99 @@
+package out
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feishuAppSink messages a user or chat as the companion's app.
+type feishuAppSink struct {
+	actor         *FeishuActor
+	receiveIdType string
+	receiveId     string
+	format        string
+}
+
+func newFeishuAppSink(actor *FeishuActor, dst, format string) (*feishuAppSink, error) {
+	receiveIdType, receiveId, ok := strings.Cut(dst, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w, missing receive_id_type or receive_id", ErrNotificationDst)
+	}
+	return &feishuAppSink{actor, receiveIdType, receiveId, format}, nil
+}
+
+func (s *feishuAppSink) Notify(n *Notification) error {
+	if s.format == NotificationFormatCard {
+		return s.actor.SendCardMessage(s.receiveIdType, s.receiveId, n.Card())
+	}
+	return s.actor.SendTextMessage(s.receiveIdType, s.receiveId, n.Text())
+}
+
+// feishuBotSink posts to a custom group bot, signed when the bot has a
+// secret.
+type feishuBotSink struct {
+	url    string
+	secret string
+	format string
+	client *http.Client
+}
+
+func newFeishuBotSink(url, secret, format string) (*feishuBotSink, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("%w, not a webhook URL", ErrNotificationDst)
+	}
+	return &feishuBotSink{url, secret, format, &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// feishuBotSign is the bot signature, the HMAC-SHA256 of nothing keyed with
+// "<timestamp>\n<secret>".
+func feishuBotSign(timestamp int64, secret string) string {
+	mac := hmac.New(sha256.New, []byte(strconv.FormatInt(timestamp, 10)+"\n"+secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *feishuBotSink) Notify(n *Notification) error {
+	msg := map[string]any{}
+	if s.format == NotificationFormatCard {
+		msg["msg_type"] = "interactive"
+		msg["card"] = n.Card()
+	} else {
+		msg["msg_type"] = "text"
+		msg["content"] = map[string]string{"text": n.Text()}
+	}
+	if s.secret != "" {
+		timestamp := time.Now().Unix()
+		msg["timestamp"] = strconv.FormatInt(timestamp, 10)
+		msg["sign"] = feishuBotSign(timestamp, s.secret)
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("feishu bot: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || r.Code != 0 {
+		return fmt.Errorf("feishu bot: %s: code %d, %s", resp.Status, r.Code, r.Msg)
+	}
+	return nil
+}
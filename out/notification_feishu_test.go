@@ -0,0 +1,87 @@
+package out
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestFeishuBotSink(t *testing.T, secret, format string, status int, reply string) (*feishuBotSink, chan receivedRequest) {
+	srv, received := newFakeWebhook(t, true, status, reply)
+	s, err := newFeishuBotSink(srv.URL, secret, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client = srv.Client()
+	return s, received
+}
+
+func TestFeishuBotSinkText(t *testing.T) {
+	s, received := newTestFeishuBotSink(t, "s3cret", NotificationFormatText, http.StatusOK, `{"code":0,"msg":"success"}`)
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+
+	var got struct {
+		MsgType   string            `json:"msg_type"`
+		Content   map[string]string `json:"content"`
+		Timestamp string            `json:"timestamp"`
+		Sign      string            `json:"sign"`
+	}
+	if err := json.Unmarshal(r.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.MsgType != "text" || got.Content["text"] != testNotification().Text() {
+		t.Errorf("got message %+v", got)
+	}
+
+	ts, err := strconv.ParseInt(got.Timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)).Abs() > time.Minute {
+		t.Errorf("got timestamp %q, want now", got.Timestamp)
+	}
+	// Feishu's documented check: HMAC-SHA256 keyed with timestamp\nsecret over nothing
+	mac := hmac.New(sha256.New, []byte(got.Timestamp+"\ns3cret"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); got.Sign != want {
+		t.Errorf("got sign %q, want %q", got.Sign, want)
+	}
+}
+
+func TestFeishuBotSinkCard(t *testing.T) {
+	s, received := newTestFeishuBotSink(t, "", NotificationFormatCard, http.StatusOK, `{"code":0,"msg":"success"}`)
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+
+	var got map[string]any
+	if err := json.Unmarshal(r.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["msg_type"] != "interactive" || got["card"] == nil {
+		t.Errorf("got message %v, want a card", got)
+	}
+	if _, signed := got["sign"]; signed {
+		t.Error("sink without secret signed the message")
+	}
+}
+
+func TestFeishuBotSinkFailure(t *testing.T) {
+	s, received := newTestFeishuBotSink(t, "wrong", NotificationFormatText, http.StatusOK, `{"code":19021,"msg":"sign match fail or timestamp is not within one hour from current time"}`)
+
+	if err := s.Notify(testNotification()); err == nil {
+		t.Error("got no error for code 19021")
+	}
+	<-received
+
+	if _, err := newFeishuBotSink("http://open.feishu.cn/open-apis/bot/v2/hook/x", "", NotificationFormatText); err == nil {
+		t.Error("accepted a plain HTTP webhook")
+	}
+}
@@ -0,0 +1,149 @@
+package out
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	NotificationTimestampHeader = "X-Companion-Timestamp"
+	NotificationSignatureHeader = "X-Companion-Signature"
+)
+
+func parseSinkUrl(dst string) error {
+	u, err := url.Parse(dst)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w, not a webhook URL", ErrNotificationDst)
+	}
+	return nil
+}
+
+func postJson(client *http.Client, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s %s", url, resp.Status, msg)
+	}
+	return nil
+}
+
+// httpSink posts the notification as JSON. With a secret it sends the unix
+// time in X-Companion-Timestamp and the hex HMAC-SHA256 of
+// "<timestamp>.<body>" in X-Companion-Signature.
+type httpSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func newHttpSink(dst, secret string) (*httpSink, error) {
+	if err := parseSinkUrl(dst); err != nil {
+		return nil, err
+	}
+	return &httpSink{dst, []byte(secret), &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (s *httpSink) Notify(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if len(s.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		header.Set(NotificationTimestampHeader, timestamp)
+		header.Set(NotificationSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	return postJson(s.client, s.url, body, header)
+}
+
+// slackColors maps the Feishu card templates to attachment colors.
+var slackColors = map[string]string{
+	"blue":      "#3370ff",
+	"wathet":    "#7ac0f8",
+	"turquoise": "#2ec7c9",
+	"green":     "#34c724",
+	"yellow":    "#ffc60a",
+	"orange":    "#ff8800",
+	"red":       "#f54a45",
+	"carmine":   "#d83931",
+	"violet":    "#c43cd8",
+	"purple":    "#7f3bf5",
+	"indigo":    "#4954e6",
+	"grey":      "#8f959e",
+}
+
+// slackSink posts a legacy attachment, which Slack and its look-alikes
+// (Mattermost, Rocket.Chat) all render.
+type slackSink struct {
+	url    string
+	client *http.Client
+}
+
+func newSlackSink(dst string) (*slackSink, error) {
+	if err := parseSinkUrl(dst); err != nil {
+		return nil, err
+	}
+	return &slackSink{dst, &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (s *slackSink) Notify(n *Notification) error {
+	type field struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+		Short bool   `json:"short"`
+	}
+	fields := []field{}
+	for _, f := range n.Fields {
+		fields = append(fields, field{f.Key, f.Value, true})
+	}
+
+	color, ok := slackColors[n.Color]
+	if !ok {
+		color = slackColors["blue"]
+	}
+
+	attachment := map[string]any{
+		"fallback": n.title() + "\n" + n.Content,
+		"color":    color,
+		"title":    n.title(),
+		"text":     n.Content,
+		"fields":   fields,
+		"footer":   n.note(),
+	}
+	if n.Timestamp > 0 {
+		attachment["ts"] = n.Timestamp
+	}
+
+	body, err := json.Marshal(map[string]any{"attachments": []any{attachment}})
+	if err != nil {
+		return err
+	}
+	return postJson(s.client, s.url, body, http.Header{})
+}
@@ -0,0 +1,164 @@
+package out
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// receivedRequest is a request a fake webhook got.
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newFakeWebhook answers with status and reply, and hands on each request.
+func newFakeWebhook(t *testing.T, tls bool, status int, reply string) (*httptest.Server, chan receivedRequest) {
+	received := make(chan receivedRequest, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{r.Header, body}
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	})
+
+	var srv *httptest.Server
+	if tls {
+		srv = httptest.NewTLSServer(handler)
+	} else {
+		srv = httptest.NewServer(handler)
+	}
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func testNotification() *Notification {
+	return &Notification{
+		Type:      "quota_exceed",
+		Title:     "Quota exceeded",
+		Content:   "alice used 100% of the quota",
+		Fields:    []NotificationField{{"user", "alice"}, {"quota", "$10.00"}},
+		Timestamp: 1760000000,
+		Color:     "red",
+		Source:    "newapi",
+		RemoteIp:  "192.0.2.1",
+		Location:  time.FixedZone("CST", 8*60*60),
+	}
+}
+
+func TestHttpSink(t *testing.T) {
+	srv, received := newFakeWebhook(t, false, http.StatusOK, "")
+	s, err := newHttpSink(srv.URL, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+
+	var got Notification
+	if err := json.Unmarshal(r.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Quota exceeded" || len(got.Fields) != 2 || got.Fields[1].Value != "$10.00" {
+		t.Errorf("got notification %+v", got)
+	}
+
+	timestamp := r.header.Get(NotificationTimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)).Abs() > time.Minute {
+		t.Errorf("got timestamp %q, want now", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(r.body)))
+	if want := hex.EncodeToString(mac.Sum(nil)); r.header.Get(NotificationSignatureHeader) != want {
+		t.Errorf("got signature %q, want %q", r.header.Get(NotificationSignatureHeader), want)
+	}
+}
+
+func TestHttpSinkUnsigned(t *testing.T) {
+	srv, received := newFakeWebhook(t, false, http.StatusOK, "")
+	s, err := newHttpSink(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+	if r.header.Get(NotificationTimestampHeader) != "" || r.header.Get(NotificationSignatureHeader) != "" {
+		t.Errorf("unsigned sink sent %v", r.header)
+	}
+}
+
+func TestHttpSinkFailure(t *testing.T) {
+	srv, received := newFakeWebhook(t, false, http.StatusBadGateway, "upstream down")
+	s, err := newHttpSink(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Notify(testNotification()); err == nil {
+		t.Error("got no error for 502")
+	}
+	<-received
+
+	if _, err := newHttpSink("ftp://example.com", ""); err == nil {
+		t.Error("accepted a non-HTTP destination")
+	}
+}
+
+func TestSlackSink(t *testing.T) {
+	srv, received := newFakeWebhook(t, false, http.StatusOK, "ok")
+	s, err := newSlackSink(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+
+	var got struct {
+		Attachments []struct {
+			Fallback string `json:"fallback"`
+			Color    string `json:"color"`
+			Title    string `json:"title"`
+			Text     string `json:"text"`
+			Fields   []struct {
+				Title string `json:"title"`
+				Value string `json:"value"`
+				Short bool   `json:"short"`
+			} `json:"fields"`
+			Footer string `json:"footer"`
+			Ts     int64  `json:"ts"`
+		} `json:"attachments"`
+	}
+	if err := json.Unmarshal(r.body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Attachments) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(got.Attachments))
+	}
+	a := got.Attachments[0]
+	if a.Title != "Quota exceeded" || a.Text != "alice used 100% of the quota" || a.Color != slackColors["red"] || a.Ts != 1760000000 {
+		t.Errorf("got attachment %+v", a)
+	}
+	if len(a.Fields) != 2 || a.Fields[0].Title != "user" || a.Fields[0].Value != "alice" || !a.Fields[0].Short {
+		t.Errorf("got fields %+v", a.Fields)
+	}
+	if a.Footer != "quota_exceed from newapi (192.0.2.1) at 2025-10-09 16:53:20 CST" {
+		t.Errorf("got footer %q", a.Footer)
+	}
+}
@@ -0,0 +1,150 @@
+package out
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// smtpTimeout bounds connecting to the server and the whole exchange after.
+const smtpTimeout = 10 * time.Second
+
+// smtpSink mails the text rendering through smtp.addr, port 465 is implicit
+// TLS, any other port uses STARTTLS when the server offers it.
+type smtpSink struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     *mail.Address
+	to       []string
+
+	implicitTls bool
+	tlsConfig   *tls.Config
+}
+
+func newSmtpSink(dst string) (*smtpSink, error) {
+	s := &smtpSink{
+		addr:     viper.GetString("smtp.addr"),
+		username: viper.GetString("smtp.username"),
+		password: viper.GetString("smtp.password"),
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("smtp.addr is required by the smtp actor")
+	}
+
+	host, port, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp.addr: %w", err)
+	}
+	s.host = host
+	s.implicitTls = port == "465"
+	s.tlsConfig = &tls.Config{ServerName: host}
+
+	from, err := mail.ParseAddress(viper.GetString("smtp.from"))
+	if err != nil {
+		return nil, fmt.Errorf("smtp.from: %w", err)
+	}
+	s.from = from
+
+	to, err := mail.ParseAddressList(dst)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %w", ErrNotificationDst, err)
+	}
+	for _, a := range to {
+		s.to = append(s.to, a.Address)
+	}
+
+	return s, nil
+}
+
+func (s *smtpSink) message(n *Notification) []byte {
+	var b bytes.Buffer
+	header := map[string]string{
+		"From":                      s.from.String(),
+		"To":                        strings.Join(s.to, ", "),
+		"Subject":                   mime.QEncoding.Encode("utf-8", n.title()),
+		"Date":                      time.Now().Format(time.RFC1123Z),
+		"MIME-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "8bit",
+	}
+	for _, k := range []string{"From", "To", "Subject", "Date", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		b.WriteString(k + ": " + header[k] + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	body := n.Text()
+	for _, f := range n.Fields {
+		body += "\n" + f.Key + ": " + f.Value
+	}
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+func (s *smtpSink) Notify(n *Notification) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if s.implicitTls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if !s.implicitTls {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(s.tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.message(n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,178 @@
+package out
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// smtpSession is what a fake SMTP server received over one connection.
+type smtpSession struct {
+	tls  bool
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// newFakeSmtp serves one session, over implicit TLS with the certificate of
+// tlsServer unless it is nil.
+func newFakeSmtp(t *testing.T, tlsServer *httptest.Server) (string, chan smtpSession) {
+	var l net.Listener
+	var err error
+	if tlsServer != nil {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: tlsServer.TLS.Certificates})
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, isTls := conn.(*tls.Conn)
+		s := smtpSession{tls: isTls}
+		defer func() { sessions <- s }()
+
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 localhost ESMTP fake")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				c.PrintfLine("250-localhost")
+				c.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				_, initial, _ := strings.Cut(arg, " ")
+				decoded, _ := base64.StdEncoding.DecodeString(initial)
+				s.auth = string(decoded)
+				c.PrintfLine("235 2.7.0 authenticated")
+			case "MAIL":
+				s.from = arg
+				c.PrintfLine("250 2.1.0 ok")
+			case "RCPT":
+				s.to = append(s.to, arg)
+				c.PrintfLine("250 2.1.5 ok")
+			case "DATA":
+				c.PrintfLine("354 go ahead")
+				data, err := c.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				s.data = string(data)
+				c.PrintfLine("250 2.0.0 queued")
+			case "QUIT":
+				c.PrintfLine("221 2.0.0 bye")
+				return
+			default:
+				c.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), sessions
+}
+
+func newTestSmtpSink(t *testing.T, addr string) *smtpSink {
+	for k, v := range map[string]string{
+		"smtp.addr":     addr,
+		"smtp.username": "companion",
+		"smtp.password": "s3cret",
+		"smtp.from":     "Companion <companion@example.com>",
+	} {
+		viper.Set(k, v)
+		t.Cleanup(func() { viper.Set(k, "") })
+	}
+
+	s, err := newSmtpSink("alice@example.com, Bob <bob@example.com>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func checkSmtpSession(t *testing.T, s smtpSession) {
+	t.Helper()
+
+	if s.auth != "\x00companion\x00s3cret" {
+		t.Errorf("got AUTH PLAIN %q", s.auth)
+	}
+	if s.from != "FROM:<companion@example.com>" {
+		t.Errorf("got MAIL %q", s.from)
+	}
+	if strings.Join(s.to, " ") != "TO:<alice@example.com> TO:<bob@example.com>" {
+		t.Errorf("got RCPT %v", s.to)
+	}
+	for _, want := range []string{
+		"From: \"Companion\" <companion@example.com>\n",
+		"To: alice@example.com, bob@example.com\n",
+		"Subject: Quota exceeded\n",
+		"Content-Type: text/plain; charset=utf-8\n",
+		"\nReceived: from 192.0.2.1\nFrom: newapi\nSubject: Quota exceeded\n\nalice used 100% of the quota\nuser: alice\nquota: $10.00\n",
+	} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestSmtpSink(t *testing.T) {
+	addr, sessions := newFakeSmtp(t, nil)
+	s := newTestSmtpSink(t, addr)
+	if s.implicitTls {
+		t.Fatal("implicit TLS on a port other than 465")
+	}
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	session := <-sessions
+	if session.tls {
+		t.Error("session is TLS")
+	}
+	checkSmtpSession(t, session)
+}
+
+func TestSmtpSinkImplicitTls(t *testing.T) {
+	if s := newTestSmtpSink(t, "smtp.example.com:465"); !s.implicitTls || s.tlsConfig.ServerName != "smtp.example.com" {
+		t.Errorf("port 465 got implicit TLS %v for %q", s.implicitTls, s.tlsConfig.ServerName)
+	}
+
+	// the fake cannot listen on 465, so the test points the sink at it
+	tlsServer := httptest.NewTLSServer(nil)
+	t.Cleanup(tlsServer.Close)
+	addr, sessions := newFakeSmtp(t, tlsServer)
+	s := newTestSmtpSink(t, addr)
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	s.implicitTls = true
+	s.tlsConfig.RootCAs = roots
+
+	if err := s.Notify(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	session := <-sessions
+	if !session.tls {
+		t.Error("session is not TLS")
+	}
+	checkSmtpSession(t, session)
+}
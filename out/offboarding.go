@@ -0,0 +1,211 @@
+package out
+
+import (
+	"database/sql"
+	"time"
+)
+
+// OffboardingStep is one pending part of offboarding (or reboarding) a
+// ZITADEL user in one system.
+type OffboardingStep struct {
+	UserId    string `json:"user_id"`
+	Step      string `json:"step"`
+	Action    string `json:"action"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	FailedAt  int64  `json:"failed_at,omitempty"`
+}
+
+// ScheduleOffboarding queues the steps for the user, replacing whatever was
+// still pending for them, e.g. an offboarding superseded by a reactivation.
+func (s *Store) ScheduleOffboarding(userId, action string, steps []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for _, step := range steps {
+		_, err := tx.Exec(
+			`INSERT OR REPLACE INTO offboarding_steps(user_id, step, action, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+			userId, step, action, now, now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimOffboardingSteps works like ClaimInboxEvents, steps that failed for
+// good are not claimed again.
+func (s *Store) ClaimOffboardingSteps(limit int, lease time.Duration) ([]*OffboardingStep, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query(
+		`SELECT user_id, step, action, attempts, last_error, created_at, failed_at
+		FROM offboarding_steps WHERE failed_at IS NULL AND next_attempt_at <= ? ORDER BY created_at LIMIT ?`,
+		now.Unix(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []*OffboardingStep{}
+	for rows.Next() {
+		step, err := scanOffboardingStep(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, step := range steps {
+		_, err := tx.Exec(
+			`UPDATE offboarding_steps SET next_attempt_at = ? WHERE user_id = ? AND step = ?`,
+			now.Add(lease).Unix(), step.UserId, step.Step,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return steps, tx.Commit()
+}
+
+// the action is part of every condition below, so a step that was replaced
+// while it ran is left alone
+
+func (s *Store) CompleteOffboardingStep(step *OffboardingStep) error {
+	_, err := s.db.Exec(
+		`DELETE FROM offboarding_steps WHERE user_id = ? AND step = ? AND action = ?`,
+		step.UserId, step.Step, step.Action,
+	)
+	return err
+}
+
+func (s *Store) RetryOffboardingStep(step *OffboardingStep, cause error, nextAttempt time.Time) error {
+	_, err := s.db.Exec(
+		`UPDATE offboarding_steps SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?
+		WHERE user_id = ? AND step = ? AND action = ?`,
+		cause.Error(), nextAttempt.Unix(), step.UserId, step.Step, step.Action,
+	)
+	return err
+}
+
+// FailOffboardingStep keeps the step for inspection but stops retrying it.
+func (s *Store) FailOffboardingStep(step *OffboardingStep, cause error) error {
+	_, err := s.db.Exec(
+		`UPDATE offboarding_steps SET attempts = attempts + 1, last_error = ?, failed_at = ?
+		WHERE user_id = ? AND step = ? AND action = ?`,
+		cause.Error(), time.Now().Unix(), step.UserId, step.Step, step.Action,
+	)
+	return err
+}
+
+func (s *Store) ListOffboardingSteps() ([]*OffboardingStep, error) {
+	rows, err := s.db.Query(
+		`SELECT user_id, step, action, attempts, last_error, created_at, failed_at
+		FROM offboarding_steps ORDER BY created_at, user_id, step`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []*OffboardingStep{}
+	for rows.Next() {
+		step, err := scanOffboardingStep(rows)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+func scanOffboardingStep(row rowScanner) (*OffboardingStep, error) {
+	var step OffboardingStep
+	var lastError sql.NullString
+	var failedAt sql.NullInt64
+	err := row.Scan(&step.UserId, &step.Step, &step.Action, &step.Attempts, &lastError, &step.CreatedAt, &failedAt)
+	if err != nil {
+		return nil, err
+	}
+	step.LastError = lastError.String
+	step.FailedAt = failedAt.Int64
+	return &step, nil
+}
+
+// RememberDisabledNewApiTokens records the tokens offboarding is about to
+// disable, so reboarding only enables those and not ones disabled by hand.
+func (s *Store) RememberDisabledNewApiTokens(userId int, tokenIds []int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range tokenIds {
+		_, err := tx.Exec(`INSERT OR REPLACE INTO newapi_disabled_tokens(token_id, user_id) VALUES (?, ?)`, id, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) DisabledNewApiTokens(userId int) ([]int, error) {
+	rows, err := s.db.Query(`SELECT token_id FROM newapi_disabled_tokens WHERE user_id = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokenIds := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		tokenIds = append(tokenIds, id)
+	}
+	return tokenIds, rows.Err()
+}
+
+func (s *Store) ForgetDisabledNewApiTokens(userId int) error {
+	_, err := s.db.Exec(`DELETE FROM newapi_disabled_tokens WHERE user_id = ?`, userId)
+	return err
+}
+
+// RememberDisabledNewApiUser records that offboarding disabled the user, so
+// reboarding does not enable one disabled by hand.
+func (s *Store) RememberDisabledNewApiUser(userId int) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO newapi_disabled_users(user_id) VALUES (?)`, userId)
+	return err
+}
+
+func (s *Store) NewApiUserDisabled(userId int) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM newapi_disabled_users WHERE user_id = ?`, userId).Scan(&n)
+	return n > 0, err
+}
+
+func (s *Store) ForgetDisabledNewApiUser(userId int) error {
+	_, err := s.db.Exec(`DELETE FROM newapi_disabled_users WHERE user_id = ?`, userId)
+	return err
+}
@@ -0,0 +1,30 @@
+package out
+
+import (
+	"time"
+)
+
+// ReportDelivered reports whether the report of the period ending at
+// periodEnd was already sent to the recipient.
+func (s *Store) ReportDelivered(report string, periodEnd time.Time, recipient string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM report_deliveries WHERE report = ? AND period_end = ? AND recipient = ?`,
+		report, periodEnd.Unix(), recipient,
+	).Scan(&n)
+	return n > 0, err
+}
+
+func (s *Store) MarkReportDelivered(report string, periodEnd time.Time, recipient string) error {
+	_, err := s.db.Exec(
+		`INSERT OR IGNORE INTO report_deliveries(report, period_end, recipient, delivered_at) VALUES (?, ?, ?, ?)`,
+		report, periodEnd.Unix(), recipient, time.Now().Unix(),
+	)
+	return err
+}
+
+// PruneReportDeliveries forgets deliveries of periods older than olderThan.
+func (s *Store) PruneReportDeliveries(olderThan time.Duration) error {
+	_, err := s.db.Exec(`DELETE FROM report_deliveries WHERE period_end < ?`, time.Now().Add(-olderThan).Unix())
+	return err
+}
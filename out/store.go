@@ -0,0 +1,112 @@
+package out
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// Store is the companion's own SQLite database, unlike NewApiActor.db which
+// belongs to New API.
+type Store struct {
+	db *sql.DB
+}
+
+var storeMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS identities (
+		id                INTEGER PRIMARY KEY AUTOINCREMENT,
+		feishu_open_id    TEXT UNIQUE,
+		feishu_union_id   TEXT UNIQUE,
+		feishu_user_id    TEXT UNIQUE,
+		zitadel_user_id   TEXT UNIQUE,
+		newapi_user_id    INTEGER UNIQUE,
+		openwebui_user_id TEXT UNIQUE,
+		email             TEXT,
+		updated_at        INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS identities_email ON identities(email)`,
+	`CREATE TABLE IF NOT EXISTS feishu_inbox (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id        TEXT NOT NULL UNIQUE,
+		event_type      TEXT NOT NULL,
+		payload         BLOB NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error      TEXT,
+		created_at      INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS feishu_inbox_next_attempt_at ON feishu_inbox(next_attempt_at)`,
+	`CREATE TABLE IF NOT EXISTS feishu_dead_letters (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id   TEXT NOT NULL UNIQUE,
+		event_type TEXT NOT NULL,
+		payload    BLOB NOT NULL,
+		attempts   INTEGER NOT NULL,
+		last_error TEXT,
+		created_at INTEGER NOT NULL,
+		failed_at  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS feishu_processed_events (
+		event_id     TEXT PRIMARY KEY,
+		processed_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS feishu_user_versions (
+		open_id     TEXT PRIMARY KEY,
+		create_time INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS feishu_group_members (
+		group_id TEXT NOT NULL,
+		open_id  TEXT NOT NULL,
+		PRIMARY KEY (group_id, open_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS offboarding_steps (
+		user_id         TEXT NOT NULL,
+		step            TEXT NOT NULL,
+		action          TEXT NOT NULL,
+		attempts        INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error      TEXT,
+		created_at      INTEGER NOT NULL,
+		failed_at       INTEGER,
+		PRIMARY KEY (user_id, step)
+	)`,
+	`CREATE TABLE IF NOT EXISTS newapi_token_policies (
+		token_group TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		applied_at  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS newapi_disabled_tokens (
+		token_id INTEGER PRIMARY KEY,
+		user_id  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS newapi_disabled_users (
+		user_id INTEGER PRIMARY KEY
+	)`,
+	`CREATE TABLE IF NOT EXISTS report_deliveries (
+		report       TEXT NOT NULL,
+		period_end   INTEGER NOT NULL,
+		recipient    TEXT NOT NULL,
+		delivered_at INTEGER NOT NULL,
+		PRIMARY KEY (report, period_end, recipient)
+	)`,
+}
+
+func NewStore(dbPath string) *Store {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		panic(err)
+	}
+	// a single connection serialises writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	for _, m := range storeMigrations {
+		if _, err := db.Exec(m); err != nil {
+			panic(err)
+		}
+	}
+
+	log.Info().Str("path", dbPath).Msg("opened companion store")
+
+	return &Store{db}
+}
@@ -0,0 +1,26 @@
+package out
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TokenPolicyFingerprint returns the fingerprint of the policy last applied
+// to the token group, or "".
+func (s *Store) TokenPolicyFingerprint(tokenGroup string) (string, error) {
+	var fingerprint string
+	err := s.db.QueryRow(`SELECT fingerprint FROM newapi_token_policies WHERE token_group = ?`, tokenGroup).Scan(&fingerprint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return fingerprint, err
+}
+
+func (s *Store) SetTokenPolicyFingerprint(tokenGroup, fingerprint string) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO newapi_token_policies(token_group, fingerprint, applied_at) VALUES (?, ?, ?)`,
+		tokenGroup, fingerprint, time.Now().Unix(),
+	)
+	return err
+}
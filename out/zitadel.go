@@ -3,30 +3,44 @@ package out
 import (
 	"context"
 	"errors"
-	"strings"
 
+	"github.com/lakelink/auth-companion/misc"
 	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 	"github.com/zitadel/zitadel-go/v3/pkg/client"
 	"github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/management"
 	"github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/object/v2"
 	user "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/user/v2"
 	"github.com/zitadel/zitadel-go/v3/pkg/zitadel"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type ZitadelActor struct {
 	ctx         context.Context
 	api         *client.Client
 	feishuIdpId string
+
+	dryRun bool
+	plan   *ZitadelPlan
+
+	idpIndex *feishuIdpIndex
+	store    *Store
+
+	metadata []misc.ZitadelMetadataConfig
+
+	nameResolver  NameResolver
+	nameTemplates *nameTemplates
 }
 
 var (
-	ErrZitadelUserNotFound  = errors.New("user not found in ZITADEL")
-	ErrZitadelRequireEnName = errors.New("the feishu user does not have larkcontact.UserEvent.EnName")
-	ErrZitadelRequireEmail  = errors.New("the feishu user does not have larkcontact.UserEvent.EnterpriseEmail")
+	ErrZitadelUserNotFound = errors.New("user not found in ZITADEL")
+	ErrZitadelRequireName  = errors.New("the feishu user has no name usable by zitadel.name.strategy")
+	ErrZitadelRequireEmail = errors.New("the feishu user does not have larkcontact.UserEvent.EnterpriseEmail")
 )
 
-func NewZitadelActor(domain, pat, feishuIdpId string) *ZitadelActor {
+func NewZitadelActor(domain, pat, feishuIdpId string, dryRun bool, store *Store) *ZitadelActor {
 	ctx := context.Background()
 
 	//create a client for the management api providing:
@@ -51,16 +65,27 @@ func NewZitadelActor(domain, pat, feishuIdpId string) *ZitadelActor {
 	}
 	log.Info().Str("orgID", resp.GetOrg().GetId()).Str("name", resp.GetOrg().GetName()).Msg("retrieved the organisation")
 
-	return &ZitadelActor{ctx, api, feishuIdpId}
+	if dryRun {
+		log.Warn().Msg("ZITADEL actor is in dry-run mode, mutations are only recorded")
+	}
+
+	var metadata []misc.ZitadelMetadataConfig
+	if err := viper.UnmarshalKey("zitadel.metadata", &metadata); err != nil {
+		log.Error().Err(err).Msg("invalid zitadel.metadata")
+	}
+
+	return &ZitadelActor{ctx, api, feishuIdpId, dryRun, &ZitadelPlan{}, &feishuIdpIndex{}, store, metadata, newNameResolver(), newNameTemplates()}
 }
 
-func (a *ZitadelActor) preflightFeishuUserEvent(e *larkcontact.UserEvent) error {
+// PreflightFeishuUserEvent reports why the feishu user cannot be synced, if
+// it cannot.
+func (a *ZitadelActor) PreflightFeishuUserEvent(e *larkcontact.UserEvent) error {
 	if e == nil {
 		return errors.New("larkcontact.UserEvent is nil")
 	}
 
-	if e.EnName == nil {
-		return ErrZitadelRequireEnName
+	if _, ok := a.nameResolver.Resolve(e); !ok {
+		return ErrZitadelRequireName
 	}
 
 	if e.EnterpriseEmail == nil {
@@ -69,22 +94,95 @@ func (a *ZitadelActor) preflightFeishuUserEvent(e *larkcontact.UserEvent) error
 	return nil
 }
 
-func (a *ZitadelActor) splitEnName(enName string) (string, string) {
-	familyName := ""
-	givenName := ""
+// IsUserStale reports whether the ZITADEL user differs from what
+// UpdateUserFromFeishu would write for the feishu user.
+func (a *ZitadelActor) IsUserStale(u *user.User, e *larkcontact.UserEvent) bool {
+	if err := a.PreflightFeishuUserEvent(e); err != nil {
+		return false
+	}
 
-	names := strings.SplitN(enName, " ", 2)
-	if len(names) >= 1 {
-		givenName = names[0]
+	human := u.GetHuman()
+	if human == nil {
+		return false
 	}
 
-	if len(names) >= 2 {
-		familyName = names[1]
-	} else {
-		log.Warn().Str("enName", enName).Int("splits", len(names)).Msg("this feishu user does not seem to have familyName")
+	want := a.profileFromFeishu(e)
+	got := human.GetProfile()
+
+	return u.GetUsername() != *e.EnterpriseEmail ||
+		human.GetEmail().GetEmail() != *e.EnterpriseEmail ||
+		got.GetDisplayName() != want.GetDisplayName() ||
+		got.GetGivenName() != want.GetGivenName() ||
+		got.GetFamilyName() != want.GetFamilyName() ||
+		(want.NickName != nil && got.GetNickName() != want.GetNickName())
+}
+
+// ListHumanUsers pages through every human user visible to the PAT.
+func (a *ZitadelActor) ListHumanUsers() ([]*user.User, error) {
+	const pageSize = 100
+
+	users := []*user.User{}
+	for offset := uint64(0); ; offset += pageSize {
+		resp, err := a.api.UserServiceV2().ListUsers(a.ctx, &user.ListUsersRequest{
+			Query: &object.ListQuery{
+				Offset: offset,
+				Limit:  pageSize,
+				Asc:    true,
+			},
+			Queries: []*user.SearchQuery{
+				{
+					Query: &user.SearchQuery_TypeQuery{
+						TypeQuery: &user.TypeQuery{
+							Type: user.Type_TYPE_HUMAN,
+						},
+					},
+				},
+			},
+		})
+		if err != nil {
+			log.Error().Err(err).Uint64("offset", offset).Msg("failed to list users")
+			return nil, err
+		}
+
+		users = append(users, resp.Result...)
+		if len(resp.Result) < pageSize || uint64(len(users)) >= resp.GetDetails().GetTotalResult() {
+			break
+		}
 	}
 
-	return givenName, familyName
+	return users, nil
+}
+
+// HasFeishuIdpLink reports whether the user is linked to the configured feishu IdP.
+func (a *ZitadelActor) HasFeishuIdpLink(userId string) (bool, error) {
+	resp, err := a.api.UserServiceV2().ListIDPLinks(a.ctx, &user.ListIDPLinksRequest{
+		UserId: userId,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to list idp links")
+		return false, err
+	}
+
+	for _, link := range resp.Result {
+		if link.GetIdpId() == a.feishuIdpId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetUser returns ErrZitadelUserNotFound for unknown IDs.
+func (a *ZitadelActor) GetUser(userId string) (*user.User, error) {
+	resp, err := a.api.UserServiceV2().GetUserByID(a.ctx, &user.GetUserByIDRequest{
+		UserId: userId,
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrZitadelUserNotFound
+	} else if err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to get user")
+		return nil, err
+	}
+	return resp.GetUser(), nil
 }
 
 func (a *ZitadelActor) ListUsersByEmail(email string) (*user.ListUsersResponse, error) {
@@ -105,36 +203,27 @@ func (a *ZitadelActor) ListUsersByEmail(email string) (*user.ListUsersResponse,
 }
 
 func (a *ZitadelActor) UpdateUserFromFeishu(e *larkcontact.UserEvent) (resp *user.UpdateHumanUserResponse, userId string, err error) {
-	if err := a.preflightFeishuUserEvent(e); err != nil {
+	if err := a.PreflightFeishuUserEvent(e); err != nil {
 		log.Error().Err(err).Str("action", "patch").Msg("missing essential fields for larkcontact.UserEvent. skipping ZITADEL sync")
-		return nil, "", errors.New("pre-flight check failed")
+		return nil, "", err
 	}
 
-	respList, err := a.ListUsersByEmail(*e.EnterpriseEmail)
+	userId, err = a.FindUserIdFromFeishu(e)
 
-	if err != nil {
-		log.Error().Err(err).Str("action", "patch").Str("loginName", *e.EnterpriseEmail).Msg("failed to list users")
+	if errors.Is(err, ErrZitadelUserNotFound) {
+		log.Error().Err(err).Str("action", "patch").Msg("skipping ZITADEL sync")
 		return nil, "", err
 	}
 
-	if len(respList.Result) < 1 {
-		err = ErrZitadelUserNotFound
-		log.Error().Err(err).Str("action", "patch").Msg("skipping ZITADEL sync")
+	if err != nil {
+		log.Error().Err(err).Str("action", "patch").Str("loginName", *e.EnterpriseEmail).Msg("failed to find user")
 		return nil, "", err
 	}
 
-	userId = respList.Result[0].GetUserId()
-
-	givenName, familyName := a.splitEnName(*e.EnName)
-
 	req := &user.UpdateHumanUserRequest{
 		UserId:   userId,
 		Username: e.EnterpriseEmail,
-		Profile: &user.SetHumanProfile{
-			DisplayName: e.EnName,
-			GivenName:   familyName,
-			FamilyName:  givenName,
-		},
+		Profile:  a.profileFromFeishu(e),
 		Email: &user.SetHumanEmail{
 			Email: *e.EnterpriseEmail,
 			Verification: &user.SetHumanEmail_IsVerified{
@@ -143,56 +232,49 @@ func (a *ZitadelActor) UpdateUserFromFeishu(e *larkcontact.UserEvent) (resp *use
 		},
 	}
 
-	resp, err = a.api.UserServiceV2().UpdateHumanUser(a.ctx, req)
+	resp, err = a.updateHumanUser(req)
 
 	if err != nil {
 		log.Error().Str("userId", userId).Err(err).Msg("failed to update user")
+	} else {
+		// failures are logged, the profile itself is up to date
+		a.SyncUserMetadataFromFeishu(userId, e)
 	}
 
-	if e.Avatar != nil {
-		reqMetadata := &management.BulkSetUserMetadataRequest{
-			Id:       userId,
-			Metadata: []*management.BulkSetUserMetadataRequest_Metadata{},
-		}
-
-		if e.Avatar.AvatarOrigin != nil {
-			reqMetadata.Metadata = append(reqMetadata.Metadata, &management.BulkSetUserMetadataRequest_Metadata{
-				Key:   "feishu:avatar_origin_url",
-				Value: []byte(*e.Avatar.AvatarOrigin),
-			})
-		}
+	return resp, userId, err
+}
 
-		if e.Avatar.Avatar240 != nil {
-			reqMetadata.Metadata = append(reqMetadata.Metadata, &management.BulkSetUserMetadataRequest_Metadata{
-				Key:   "feishu:avatar_240_url",
-				Value: []byte(*e.Avatar.Avatar240),
-			})
-		}
-		_, errMetadata := a.api.ManagementService().BulkSetUserMetadata(a.ctx, reqMetadata)
+func (a *ZitadelActor) updateHumanUser(req *user.UpdateHumanUserRequest) (*user.UpdateHumanUserResponse, error) {
+	if a.planned("UpdateHumanUser", req) {
+		return &user.UpdateHumanUserResponse{}, nil
+	}
+	return a.api.UserServiceV2().UpdateHumanUser(a.ctx, req)
+}
 
-		if errMetadata != nil {
-			log.Error().Str("userId", userId).Any("metadata", reqMetadata.Metadata).Err(errMetadata).Msg("failed to update metadata")
-		}
+func (a *ZitadelActor) addHumanUser(req *user.AddHumanUserRequest) (*user.AddHumanUserResponse, error) {
+	if a.planned("AddHumanUser", req) {
+		return &user.AddHumanUserResponse{UserId: ZitadelDryRunUserId}, nil
 	}
+	return a.api.UserServiceV2().AddHumanUser(a.ctx, req)
+}
 
-	return resp, userId, err
+func (a *ZitadelActor) BulkSetUserMetadata(req *management.BulkSetUserMetadataRequest) error {
+	if a.planned("BulkSetUserMetadata", req) {
+		return nil
+	}
+	_, err := a.api.ManagementService().BulkSetUserMetadata(a.ctx, req)
+	return err
 }
 
 func (a *ZitadelActor) AddUserFromFeishu(e *larkcontact.UserEvent) (resp *user.AddHumanUserResponse, userId string, err error) {
-	if err := a.preflightFeishuUserEvent(e); err != nil {
+	if err := a.PreflightFeishuUserEvent(e); err != nil {
 		log.Error().Err(err).Str("action", "add").Msg("missing essential fields for larkcontact.UserEvent. skipping ZITADEL sync")
-		return nil, "", errors.New("pre-flight check failed")
+		return nil, "", err
 	}
 
-	givenName, familyName := a.splitEnName(*e.EnName)
-
 	req := &user.AddHumanUserRequest{
 		Username: e.EnterpriseEmail,
-		Profile: &user.SetHumanProfile{
-			DisplayName: e.EnName,
-			GivenName:   familyName,
-			FamilyName:  givenName,
-		},
+		Profile:  a.profileFromFeishu(e),
 		Email: &user.SetHumanEmail{
 			Email: *e.EnterpriseEmail,
 			Verification: &user.SetHumanEmail_IsVerified{
@@ -220,60 +302,37 @@ func (a *ZitadelActor) AddUserFromFeishu(e *larkcontact.UserEvent) (resp *user.A
 		})
 	}
 
-	if e.Avatar != nil {
-		if e.Avatar.AvatarOrigin != nil {
-			req.Metadata = append(req.Metadata, &user.SetMetadataEntry{
-				Key:   "feishu:avatar_origin_url",
-				Value: []byte(*e.Avatar.AvatarOrigin),
-			})
-		}
-
-		if e.Avatar.Avatar240 != nil {
-			req.Metadata = append(req.Metadata, &user.SetMetadataEntry{
-				Key:   "feishu:avatar_240_url",
-				Value: []byte(*e.Avatar.Avatar240),
-			})
-		}
+	metadata, _ := a.metadataFromFeishu(e)
+	for _, m := range metadata {
+		req.Metadata = append(req.Metadata, &user.SetMetadataEntry{
+			Key:   m.Key,
+			Value: m.Value,
+		})
 	}
 
-	resp, err = a.api.UserServiceV2().AddHumanUser(a.ctx, req)
+	resp, err = a.addHumanUser(req)
 
 	if err != nil {
-		log.Error().Err(err).Str("loginName", *e.EnterpriseEmail).Str("enName", *e.EnName).Msg("failed to add user")
+		log.Error().Err(err).Str("loginName", *e.EnterpriseEmail).Any("name", e.Name).Any("enName", e.EnName).Msg("failed to add user")
+	} else {
+		if e.UnionId != nil {
+			a.rememberFeishuIdpLink(*e.UnionId, resp.GetUserId(), *e.EnterpriseEmail)
+		}
+		a.linkFeishuIdentity(e, resp.GetUserId())
 	}
 
 	return resp, resp.GetUserId(), err
 }
 
-func (a *ZitadelActor) DeactivateUserFromFeishu(e *larkcontact.UserEvent) (userId string, err error) {
-	if e.EnterpriseEmail == nil {
-		err := errors.New("larkcontact.UserEvent.EnterpriseEmail is nil")
-		log.Error().Err(err).Str("action", "deactivate").Msg("missing essential fields for larkcontact.UserEvent. skipping ZITADEL sync")
-		return "", err
-	}
-
-	respList, err := a.ListUsersByEmail(*e.EnterpriseEmail)
-
-	if err != nil {
-		log.Error().Err(err).Str("action", "deactivate").Str("loginName", *e.EnterpriseEmail).Msg("failed to list ZITADEL users")
-		return "", err
+func (a *ZitadelActor) DeactivateUser(userId string) error {
+	req := &user.DeactivateUserRequest{
+		UserId: userId,
 	}
-
-	if len(respList.Result) < 1 {
-		err = ErrZitadelUserNotFound
-		log.Error().Err(err).Str("action", "deactivate").Str("loginName", *e.EnterpriseEmail).Msg("skipping ZITADEL sync")
-		return "", err
+	if a.planned("DeactivateUser", req) {
+		return nil
 	}
 
-	userId = respList.Result[0].GetUserId()
-	err = a.DeactivateUser(userId)
-	return userId, err
-}
-
-func (a *ZitadelActor) DeactivateUser(userId string) error {
-	_, err := a.api.UserServiceV2().DeactivateUser(a.ctx, &user.DeactivateUserRequest{
-		UserId: userId,
-	})
+	_, err := a.api.UserServiceV2().DeactivateUser(a.ctx, req)
 
 	if err != nil {
 		log.Error().Err(err).Str("action", "deactivate").Str("userId", userId).Msg("failed to deactivate ZITADEL user")
@@ -283,9 +342,14 @@ func (a *ZitadelActor) DeactivateUser(userId string) error {
 }
 
 func (a *ZitadelActor) ReactivateUser(userId string) error {
-	_, err := a.api.UserServiceV2().ReactivateUser(a.ctx, &user.ReactivateUserRequest{
+	req := &user.ReactivateUserRequest{
 		UserId: userId,
-	})
+	}
+	if a.planned("ReactivateUser", req) {
+		return nil
+	}
+
+	_, err := a.api.UserServiceV2().ReactivateUser(a.ctx, req)
 
 	if err != nil {
 		log.Error().Err(err).Str("action", "reactivate").Str("userId", userId).Msg("could not reactivate user")
@@ -0,0 +1,101 @@
+package out
+
+import (
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/management"
+	userv1 "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/user"
+)
+
+// ZitadelGrantSet maps ZITADEL project IDs to role keys.
+type ZitadelGrantSet map[string][]string
+
+func (s ZitadelGrantSet) Add(projectId string, roleKeys ...string) {
+	for _, k := range roleKeys {
+		if !slices.Contains(s[projectId], k) {
+			s[projectId] = append(s[projectId], k)
+		}
+	}
+}
+
+func (a *ZitadelActor) ListUserGrants(userId string) ([]*userv1.UserGrant, error) {
+	resp, err := a.api.ManagementService().ListUserGrants(a.ctx, &management.ListUserGrantRequest{
+		Queries: []*userv1.UserGrantQuery{
+			{
+				Query: &userv1.UserGrantQuery_UserIdQuery{
+					UserIdQuery: &userv1.UserGrantUserIDQuery{
+						UserId: userId,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to list user grants")
+		return nil, err
+	}
+
+	return resp.Result, nil
+}
+
+// SyncUserGrants makes the managed roles the user holds equal to desired.
+// Roles outside of managed, e.g. granted by hand, are left untouched.
+func (a *ZitadelActor) SyncUserGrants(userId string, desired, managed ZitadelGrantSet) error {
+	grants, err := a.ListUserGrants(userId)
+	if err != nil {
+		return err
+	}
+
+	byProject := map[string]*userv1.UserGrant{}
+	for _, g := range grants {
+		byProject[g.GetProjectId()] = g
+	}
+
+	for projectId, managedRoles := range managed {
+		roles := []string{}
+		grant, exists := byProject[projectId]
+		if exists {
+			for _, k := range grant.GetRoleKeys() {
+				if !slices.Contains(managedRoles, k) {
+					roles = append(roles, k)
+				}
+			}
+		}
+		for _, k := range desired[projectId] {
+			if !slices.Contains(roles, k) {
+				roles = append(roles, k)
+			}
+		}
+		slices.Sort(roles)
+
+		var err error
+		switch {
+		case !exists && len(roles) > 0:
+			req := &management.AddUserGrantRequest{UserId: userId, ProjectId: projectId, RoleKeys: roles}
+			if !a.planned("AddUserGrant", req) {
+				_, err = a.api.ManagementService().AddUserGrant(a.ctx, req)
+			}
+		case exists && len(roles) == 0:
+			req := &management.RemoveUserGrantRequest{UserId: userId, GrantId: grant.GetId()}
+			if !a.planned("RemoveUserGrant", req) {
+				_, err = a.api.ManagementService().RemoveUserGrant(a.ctx, req)
+			}
+		case exists && !slices.Equal(roles, slices.Sorted(slices.Values(grant.GetRoleKeys()))):
+			req := &management.UpdateUserGrantRequest{UserId: userId, GrantId: grant.GetId(), RoleKeys: roles}
+			if !a.planned("UpdateUserGrant", req) {
+				_, err = a.api.ManagementService().UpdateUserGrant(a.ctx, req)
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			log.Error().Err(err).Str("userId", userId).Str("projectId", projectId).Strs("roles", roles).Msg("failed to sync user grant")
+			return err
+		}
+		log.Info().Str("userId", userId).Str("projectId", projectId).Strs("roles", roles).Msg("user grant synced")
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package out
+
+import (
+	"sync"
+	"time"
+
+	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
+	"github.com/rs/zerolog/log"
+	user "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/user/v2"
+)
+
+// ZITADEL cannot search users by IdP link, so the links are indexed locally
+// and the index is rebuilt at most this often when a union_id is unknown.
+const feishuIdpIndexMinAge = 5 * time.Minute
+
+type feishuIdpLink struct {
+	userId    string
+	idpUserId string // the feishu ID the link was made with
+	userName  string
+}
+
+type feishuIdpIndex struct {
+	mu      sync.Mutex
+	links   map[string]feishuIdpLink // union_id -> link
+	builtAt time.Time
+}
+
+// buildFeishuIdpIndex lists the IdP links of every user, one call each, so
+// it runs without holding the index lock.
+func (a *ZitadelActor) buildFeishuIdpIndex() (map[string]feishuIdpLink, error) {
+	users, err := a.ListHumanUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	links := map[string]feishuIdpLink{}
+	for _, u := range users {
+		resp, err := a.api.UserServiceV2().ListIDPLinks(a.ctx, &user.ListIDPLinksRequest{
+			UserId: u.GetUserId(),
+		})
+		if err != nil {
+			log.Error().Err(err).Str("userId", u.GetUserId()).Msg("failed to list idp links")
+			return nil, err
+		}
+
+		for _, link := range resp.Result {
+			if link.GetIdpId() == a.feishuIdpId {
+				links[link.GetUserId()] = feishuIdpLink{u.GetUserId(), link.GetUserId(), link.GetUserName()}
+			}
+		}
+	}
+
+	log.Info().Int("users", len(users)).Int("links", len(links)).Msg("rebuilt feishu idp link index")
+	return links, nil
+}
+
+func (a *ZitadelActor) lookupFeishuIdpLink(unionId string) (feishuIdpLink, bool, error) {
+	a.idpIndex.mu.Lock()
+
+	if link, ok := a.idpIndex.links[unionId]; ok {
+		a.idpIndex.mu.Unlock()
+		return link, true, nil
+	}
+
+	if i, err := a.store.LookupIdentity(unionId); err == nil && i.ZitadelUserId != "" {
+		link := feishuIdpLink{i.ZitadelUserId, unionId, i.Email}
+		if a.idpIndex.links == nil {
+			a.idpIndex.links = map[string]feishuIdpLink{}
+		}
+		a.idpIndex.links[unionId] = link
+		a.idpIndex.mu.Unlock()
+		return link, true, nil
+	}
+
+	builtAt := a.idpIndex.builtAt
+	if time.Since(builtAt) < feishuIdpIndexMinAge {
+		a.idpIndex.mu.Unlock()
+		return feishuIdpLink{}, false, nil
+	}
+
+	// claim the rebuild, lookups meanwhile see the old index
+	a.idpIndex.builtAt = time.Now()
+	a.idpIndex.mu.Unlock()
+
+	links, err := a.buildFeishuIdpIndex()
+
+	a.idpIndex.mu.Lock()
+	defer a.idpIndex.mu.Unlock()
+	if err != nil {
+		a.idpIndex.builtAt = builtAt
+		return feishuIdpLink{}, false, err
+	}
+	a.idpIndex.links = links
+
+	link, ok := links[unionId]
+	return link, ok, nil
+}
+
+func (a *ZitadelActor) rememberFeishuIdpLink(unionId, userId, userName string) {
+	if a.dryRun {
+		return
+	}
+
+	a.idpIndex.mu.Lock()
+	defer a.idpIndex.mu.Unlock()
+
+	if a.idpIndex.links == nil {
+		a.idpIndex.links = map[string]feishuIdpLink{}
+	}
+	a.idpIndex.links[unionId] = feishuIdpLink{userId, unionId, userName}
+}
+
+// indexedFeishuIdpLink finds a link made with another feishu ID than the
+// union_id in the index as it is.
+func (a *ZitadelActor) indexedFeishuIdpLink(ids ...*string) (feishuIdpLink, bool) {
+	a.idpIndex.mu.Lock()
+	defer a.idpIndex.mu.Unlock()
+
+	for _, id := range ids {
+		if id == nil {
+			continue
+		}
+		if link, ok := a.idpIndex.links[*id]; ok {
+			return link, true
+		}
+	}
+	return feishuIdpLink{}, false
+}
+
+// LookupFeishuIdpLink returns the ZITADEL user linked to the feishu union_id.
+func (a *ZitadelActor) LookupFeishuIdpLink(unionId string) (userId string, ok bool, err error) {
+	link, ok, err := a.lookupFeishuIdpLink(unionId)
+	return link.userId, ok, err
+}
+
+// FindUserIdFromFeishu locates the ZITADEL user of a feishu user, first by the
+// feishu IdP link and then by enterprise email. A user found only by email
+// gets the IdP link added so the next lookup survives an email change.
+func (a *ZitadelActor) FindUserIdFromFeishu(e *larkcontact.UserEvent) (string, error) {
+	if e.UnionId != nil {
+		link, ok, err := a.lookupFeishuIdpLink(*e.UnionId)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			link, ok = a.indexedFeishuIdpLink(e.OpenId, e.UserId)
+		}
+		if ok {
+			if link.idpUserId != *e.UnionId {
+				a.migrateFeishuIdpLink(link, *e.UnionId, larkcore.StringValue(e.EnterpriseEmail))
+			}
+			a.linkFeishuIdentity(e, link.userId)
+			return link.userId, nil
+		}
+	}
+
+	if e.EnterpriseEmail == nil {
+		return "", ErrZitadelUserNotFound
+	}
+
+	respList, err := a.ListUsersByEmail(*e.EnterpriseEmail)
+	if err != nil {
+		log.Error().Err(err).Str("loginName", *e.EnterpriseEmail).Msg("failed to list users")
+		return "", err
+	}
+
+	if len(respList.Result) < 1 {
+		return "", ErrZitadelUserNotFound
+	}
+
+	userId := respList.Result[0].GetUserId()
+
+	if e.UnionId != nil {
+		err = a.addFeishuIdpLink(userId, *e.UnionId, *e.EnterpriseEmail)
+		if err != nil {
+			log.Warn().Err(err).Str("userId", userId).Str("unionId", *e.UnionId).Msg("could not link feishu idp to user found by email")
+		}
+	}
+
+	a.linkFeishuIdentity(e, userId)
+	return userId, nil
+}
+
+func (a *ZitadelActor) linkFeishuIdentity(e *larkcontact.UserEvent, userId string) {
+	if a.dryRun {
+		return
+	}
+
+	link := Identity{ZitadelUserId: userId}
+	for _, f := range []struct {
+		dst *string
+		src *string
+	}{
+		{&link.FeishuOpenId, e.OpenId},
+		{&link.FeishuUnionId, e.UnionId},
+		{&link.FeishuUserId, e.UserId},
+		{&link.Email, e.EnterpriseEmail},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+
+	a.store.linkIdentity(link)
+}
+
+func (a *ZitadelActor) addFeishuIdpLink(userId, unionId, userName string) error {
+	req := &user.AddIDPLinkRequest{
+		UserId: userId,
+		IdpLink: &user.IDPLink{
+			IdpId:    a.feishuIdpId,
+			UserId:   unionId,
+			UserName: userName,
+		},
+	}
+	if !a.planned("AddIDPLink", req) {
+		if _, err := a.api.UserServiceV2().AddIDPLink(a.ctx, req); err != nil {
+			return err
+		}
+	}
+
+	a.rememberFeishuIdpLink(unionId, userId, userName)
+	return nil
+}
+
+// migrateFeishuIdpLink re-creates an IdP link made with another feishu ID
+// under the union_id. Only the IdP user ID identifies the link, its username
+// is informational and left alone.
+func (a *ZitadelActor) migrateFeishuIdpLink(link feishuIdpLink, unionId, userName string) {
+	userId := link.userId
+	log.Info().Str("userId", userId).Str("from", link.idpUserId).Str("to", unionId).Msg("feishu idp user id changed, migrating idp link")
+
+	req := &user.RemoveIDPLinkRequest{
+		UserId:       userId,
+		IdpId:        a.feishuIdpId,
+		LinkedUserId: link.idpUserId,
+	}
+	if !a.planned("RemoveIDPLink", req) {
+		if _, err := a.api.UserServiceV2().RemoveIDPLink(a.ctx, req); err != nil {
+			log.Error().Err(err).Str("userId", userId).Msg("failed to remove outdated idp link")
+			return
+		}
+	}
+
+	if userName == "" {
+		userName = link.userName
+	}
+	if err := a.addFeishuIdpLink(userId, unionId, userName); err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to re-add idp link")
+	}
+}
@@ -0,0 +1,145 @@
+package out
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
+	"github.com/rs/zerolog/log"
+	"github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/management"
+)
+
+// feishuUserField resolves a dotted JSON path in the feishu user. Missing
+// fields, nulls, empty strings and empty lists all count as absent.
+func feishuUserField(fields map[string]any, path string) ([]byte, bool) {
+	var v any = fields
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		v = m[name]
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return []byte(v), v != ""
+	case []any:
+		if len(v) == 0 {
+			return nil, false
+		}
+	case map[string]any:
+		if len(v) == 0 {
+			return nil, false
+		}
+	}
+
+	b, err := json.Marshal(v)
+	return b, err == nil
+}
+
+// metadataFromFeishu returns the configured metadata the feishu user has a
+// value for, and the keys of the ones it has not.
+func (a *ZitadelActor) metadataFromFeishu(e *larkcontact.UserEvent) ([]*management.BulkSetUserMetadataRequest_Metadata, []string) {
+	present := []*management.BulkSetUserMetadataRequest_Metadata{}
+	absent := []string{}
+	if len(a.metadata) == 0 {
+		return present, absent
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode feishu user for metadata")
+		return present, absent
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		log.Error().Err(err).Msg("failed to decode feishu user for metadata")
+		return present, absent
+	}
+
+	for _, m := range a.metadata {
+		if value, ok := feishuUserField(fields, m.Field); ok {
+			present = append(present, &management.BulkSetUserMetadataRequest_Metadata{
+				Key:   m.Key,
+				Value: value,
+			})
+		} else {
+			absent = append(absent, m.Key)
+		}
+	}
+
+	return present, absent
+}
+
+func (a *ZitadelActor) ListUserMetadataKeys(userId string) ([]string, error) {
+	resp, err := a.api.ManagementService().ListUserMetadata(a.ctx, &management.ListUserMetadataRequest{
+		Id: userId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, m := range resp.Result {
+		keys = append(keys, m.GetKey())
+	}
+	return keys, nil
+}
+
+func (a *ZitadelActor) BulkRemoveUserMetadata(req *management.BulkRemoveUserMetadataRequest) error {
+	if a.planned("BulkRemoveUserMetadata", req) {
+		return nil
+	}
+	_, err := a.api.ManagementService().BulkRemoveUserMetadata(a.ctx, req)
+	return err
+}
+
+// SyncUserMetadataFromFeishu writes the configured metadata of the feishu user
+// and removes the keys whose field the user no longer has. Metadata outside
+// of zitadel.metadata is left untouched.
+func (a *ZitadelActor) SyncUserMetadataFromFeishu(userId string, e *larkcontact.UserEvent) error {
+	present, absent := a.metadataFromFeishu(e)
+
+	if len(present) > 0 {
+		req := &management.BulkSetUserMetadataRequest{
+			Id:       userId,
+			Metadata: present,
+		}
+		if err := a.BulkSetUserMetadata(req); err != nil {
+			log.Error().Str("userId", userId).Any("metadata", req.Metadata).Err(err).Msg("failed to update metadata")
+			return err
+		}
+	}
+
+	if len(absent) == 0 {
+		return nil
+	}
+
+	existing, err := a.ListUserMetadataKeys(userId)
+	if err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to list metadata")
+		return err
+	}
+
+	stale := []string{}
+	for _, k := range absent {
+		if slices.Contains(existing, k) {
+			stale = append(stale, k)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	if err := a.BulkRemoveUserMetadata(&management.BulkRemoveUserMetadataRequest{Id: userId, Keys: stale}); err != nil {
+		log.Error().Err(err).Str("userId", userId).Strs("keys", stale).Msg("failed to remove metadata")
+		return err
+	}
+	log.Info().Str("userId", userId).Strs("keys", stale).Msg("removed metadata without feishu source")
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package out
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+	"unicode"
+
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	user "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/user/v2"
+)
+
+// FeishuName is a feishu user's name split the way ZITADEL stores it.
+type FeishuName struct {
+	GivenName  string
+	FamilyName string
+
+	// the source fields, for the display and nick name templates
+	Name     string
+	EnName   string
+	Nickname string
+	Email    string
+}
+
+// NameResolver splits the name of a feishu user, reporting false when the
+// user has no name the strategy can use.
+type NameResolver interface {
+	Resolve(e *larkcontact.UserEvent) (*FeishuName, bool)
+}
+
+// nameResolvers are the strategies selectable by zitadel.name.strategy.
+var nameResolvers = map[string]NameResolver{
+	// en_name only, the original behaviour
+	"en_name": enNameResolver{},
+	// name only, CJK names are read family name first
+	"name": localNameResolver{},
+	// en_name, falling back to name
+	"auto": fallbackNameResolver{enNameResolver{}, localNameResolver{}},
+}
+
+type enNameResolver struct{}
+
+func (enNameResolver) Resolve(e *larkcontact.UserEvent) (*FeishuName, bool) {
+	if e.EnName == nil || strings.TrimSpace(*e.EnName) == "" {
+		return nil, false
+	}
+	givenName, familyName := splitWesternName(*e.EnName)
+	return newFeishuName(e, givenName, familyName), true
+}
+
+type localNameResolver struct{}
+
+func (localNameResolver) Resolve(e *larkcontact.UserEvent) (*FeishuName, bool) {
+	if e.Name == nil || strings.TrimSpace(*e.Name) == "" {
+		return nil, false
+	}
+
+	var givenName, familyName string
+	if isCJKName(*e.Name) {
+		givenName, familyName = splitCJKName(*e.Name)
+	} else {
+		givenName, familyName = splitWesternName(*e.Name)
+	}
+	return newFeishuName(e, givenName, familyName), true
+}
+
+type fallbackNameResolver []NameResolver
+
+func (r fallbackNameResolver) Resolve(e *larkcontact.UserEvent) (*FeishuName, bool) {
+	for _, resolver := range r {
+		if name, ok := resolver.Resolve(e); ok {
+			return name, true
+		}
+	}
+	return nil, false
+}
+
+func newFeishuName(e *larkcontact.UserEvent, givenName, familyName string) *FeishuName {
+	n := &FeishuName{GivenName: givenName, FamilyName: familyName}
+	if e.Name != nil {
+		n.Name = strings.TrimSpace(*e.Name)
+	}
+	if e.EnName != nil {
+		n.EnName = strings.TrimSpace(*e.EnName)
+	}
+	if e.Nickname != nil {
+		n.Nickname = strings.TrimSpace(*e.Nickname)
+	}
+	if e.EnterpriseEmail != nil {
+		n.Email = *e.EnterpriseEmail
+	}
+	return n
+}
+
+// splitWesternName reads "Given Middle Family", ZITADEL requires both parts
+// so a single word is used for both.
+func splitWesternName(name string) (string, string) {
+	words := strings.Fields(name)
+	if len(words) == 1 {
+		log.Warn().Str("name", name).Msg("this feishu user does not seem to have familyName")
+		return words[0], words[0]
+	}
+	return strings.Join(words[:len(words)-1], " "), words[len(words)-1]
+}
+
+func isCJKName(name string) bool {
+	for _, r := range name {
+		if unicode.In(r, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana) {
+			return true
+		}
+	}
+	return false
+}
+
+// chineseCompoundSurnames are the two-character family names still in use,
+// everything else is taken to be a single character.
+var chineseCompoundSurnames = []string{
+	"欧阳", "司马", "诸葛", "上官", "东方", "皇甫", "尉迟", "公孙", "慕容", "令狐",
+	"长孙", "宇文", "司徒", "夏侯", "端木", "独孤", "南宫", "西门", "申屠", "轩辕",
+	"钟离", "闻人", "赫连", "澹台", "呼延", "太史", "万俟", "百里", "东郭", "司空",
+}
+
+func isJapaneseName(name string) bool {
+	for _, r := range name {
+		if unicode.In(r, unicode.Hiragana, unicode.Katakana) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCJKName reads the family name first. Transliterated names such as
+// "迪丽热巴·迪力木拉提" keep the given name first, and names written with a
+// space ("山田 太郎") are split there. Japanese family names are mostly two
+// characters or more, so a Japanese name without a space is left unsplit.
+func splitCJKName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+
+	for _, sep := range []string{"·", "・", "•"} {
+		if given, family, ok := strings.Cut(name, sep); ok && given != "" && family != "" {
+			return given, family
+		}
+	}
+
+	if words := strings.Fields(name); len(words) == 2 {
+		return words[1], words[0]
+	}
+
+	name = strings.Join(strings.Fields(name), "")
+	runes := []rune(name)
+	if len(runes) < 2 || isJapaneseName(name) {
+		return name, name
+	}
+
+	surnameLength := 1
+	if len(runes) > 2 {
+		for _, s := range chineseCompoundSurnames {
+			if strings.HasPrefix(name, s) {
+				surnameLength = 2
+				break
+			}
+		}
+	}
+
+	return string(runes[surnameLength:]), string(runes[:surnameLength])
+}
+
+// nameTemplates renders the display and nick name, an empty nick name
+// template leaves the nick name unset.
+type nameTemplates struct {
+	displayName *template.Template
+	nickName    *template.Template
+}
+
+func newNameTemplates() *nameTemplates {
+	t := &nameTemplates{}
+
+	var err error
+	t.displayName, err = template.New("display_name").Parse(viper.GetString("zitadel.name.display_name"))
+	if err != nil {
+		panic(err)
+	}
+
+	if nickName := viper.GetString("zitadel.name.nick_name"); nickName != "" {
+		t.nickName, err = template.New("nick_name").Parse(nickName)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return t
+}
+
+func renderName(t *template.Template, n *FeishuName) string {
+	var b bytes.Buffer
+	if err := t.Execute(&b, n); err != nil {
+		log.Error().Err(err).Str("template", t.Name()).Msg("failed to render name")
+		return ""
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func newNameResolver() NameResolver {
+	strategy := viper.GetString("zitadel.name.strategy")
+	resolver, ok := nameResolvers[strategy]
+	if !ok {
+		log.Error().Str("strategy", strategy).Msg("unknown zitadel.name.strategy, using auto")
+		return nameResolvers["auto"]
+	}
+	return resolver
+}
+
+func (a *ZitadelActor) profileFromFeishu(e *larkcontact.UserEvent) *user.SetHumanProfile {
+	n, ok := a.nameResolver.Resolve(e)
+	if !ok {
+		return nil
+	}
+
+	profile := &user.SetHumanProfile{
+		GivenName:  n.GivenName,
+		FamilyName: n.FamilyName,
+	}
+
+	if displayName := renderName(a.nameTemplates.displayName, n); displayName != "" {
+		profile.DisplayName = &displayName
+	}
+	if a.nameTemplates.nickName != nil {
+		if nickName := renderName(a.nameTemplates.nickName, n); nickName != "" {
+			profile.NickName = &nickName
+		}
+	}
+
+	return profile
+}
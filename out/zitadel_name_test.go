@@ -0,0 +1,62 @@
+package out
+
+import (
+	"testing"
+
+	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
+)
+
+func TestResolveName(t *testing.T) {
+	tests := []struct {
+		strategy string
+		name     string
+		enName   string
+
+		ok         bool
+		givenName  string
+		familyName string
+	}{
+		{"name", "张三", "", true, "三", "张"},
+		{"name", "王小明", "", true, "小明", "王"},
+		{"name", "欧阳娜娜", "", true, "娜娜", "欧阳"},
+		{"name", "迪丽热巴·迪力木拉提", "", true, "迪丽热巴", "迪力木拉提"},
+		{"name", "山田 太郎", "", true, "太郎", "山田"},
+		{"name", "佐々木みどり", "", true, "佐々木みどり", "佐々木みどり"},
+		{"name", "タナカ ハナコ", "", true, "ハナコ", "タナカ"},
+		{"name", "김민준", "", true, "민준", "김"},
+		{"name", "John Ronald Tolkien", "", true, "John Ronald", "Tolkien"},
+		{"name", "李", "", true, "李", "李"},
+		{"name", "Madonna", "", true, "Madonna", "Madonna"},
+		{"name", "", "Zhang San", false, "", ""},
+		{"name", "  ", "", false, "", ""},
+		{"en_name", "张三", "San Zhang", true, "San", "Zhang"},
+		{"en_name", "张三", "", false, "", ""},
+		{"auto", "张三", "San Zhang", true, "San", "Zhang"},
+		{"auto", "张三", " ", true, "三", "张"},
+		{"auto", "", "San Zhang", true, "San", "Zhang"},
+		{"auto", "", "", false, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy+"/"+tt.name+"/"+tt.enName, func(t *testing.T) {
+			e := &larkcontact.UserEvent{}
+			if tt.name != "" {
+				e.Name = &tt.name
+			}
+			if tt.enName != "" {
+				e.EnName = &tt.enName
+			}
+
+			n, ok := nameResolvers[tt.strategy].Resolve(e)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if n.GivenName != tt.givenName || n.FamilyName != tt.familyName {
+				t.Errorf("got given %q family %q, want given %q family %q", n.GivenName, n.FamilyName, tt.givenName, tt.familyName)
+			}
+		})
+	}
+}
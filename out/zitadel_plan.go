@@ -0,0 +1,83 @@
+package out
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ZitadelDryRunUserId stands in for the ID of a user that would have been
+// created if the actor were not in dry-run mode.
+const ZitadelDryRunUserId = "dry-run"
+
+type ZitadelPlanStep struct {
+	Time    time.Time       `json:"time"`
+	Method  string          `json:"method"`
+	Request json.RawMessage `json:"request"`
+}
+
+// ZitadelPlan collects the mutations a dry-run ZitadelActor would have sent.
+type ZitadelPlan struct {
+	mu    sync.Mutex
+	steps []ZitadelPlanStep
+}
+
+func (p *ZitadelPlan) Steps() []ZitadelPlanStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	steps := make([]ZitadelPlanStep, len(p.steps))
+	copy(steps, p.steps)
+	return steps
+}
+
+func (p *ZitadelPlan) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = nil
+}
+
+func (p *ZitadelPlan) add(method string, req proto.Message) {
+	b, err := protojson.Marshal(req)
+	if err != nil {
+		log.Error().Err(err).Str("method", method).Msg("failed to marshal planned request")
+		b = []byte("null")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, ZitadelPlanStep{time.Now(), method, b})
+}
+
+// DryRun returns a copy of the actor that shares the ZITADEL connection but
+// records every mutation into its own fresh plan instead of executing it.
+func (a *ZitadelActor) DryRun() *ZitadelActor {
+	c := *a
+	c.dryRun = true
+	c.plan = &ZitadelPlan{}
+	return &c
+}
+
+func (a *ZitadelActor) IsDryRun() bool {
+	return a.dryRun
+}
+
+func (a *ZitadelActor) Plan() *ZitadelPlan {
+	return a.plan
+}
+
+// planned records the request and reports whether the caller must skip the
+// actual gRPC call.
+func (a *ZitadelActor) planned(method string, req proto.Message) bool {
+	if !a.dryRun {
+		return false
+	}
+
+	a.plan.add(method, req)
+	log.Info().Str("method", method).Msg("dry-run: recorded ZITADEL mutation")
+	return true
+}
@@ -0,0 +1,42 @@
+package out
+
+import (
+	"github.com/rs/zerolog/log"
+	session "github.com/zitadel/zitadel-go/v3/pkg/client/zitadel/session/v2"
+)
+
+// TerminateUserSessions deletes every session of the user, signing them out
+// of all applications.
+func (a *ZitadelActor) TerminateUserSessions(userId string) error {
+	resp, err := a.api.SessionServiceV2().ListSessions(a.ctx, &session.ListSessionsRequest{
+		Queries: []*session.SearchQuery{
+			{
+				Query: &session.SearchQuery_UserIdQuery{
+					UserIdQuery: &session.UserIDQuery{
+						Id: userId,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("userId", userId).Msg("failed to list sessions")
+		return err
+	}
+
+	for _, s := range resp.GetSessions() {
+		req := &session.DeleteSessionRequest{SessionId: s.GetId()}
+		if a.planned("DeleteSession", req) {
+			continue
+		}
+		if _, err := a.api.SessionServiceV2().DeleteSession(a.ctx, req); err != nil {
+			log.Error().Err(err).Str("userId", userId).Str("sessionId", s.GetId()).Msg("failed to delete session")
+			return err
+		}
+	}
+
+	if len(resp.GetSessions()) > 0 {
+		log.Info().Str("userId", userId).Int("sessions", len(resp.GetSessions())).Msg("terminated user sessions")
+	}
+	return nil
+}